@@ -0,0 +1,45 @@
+package hls
+
+import (
+   "errors"
+   "fmt"
+   "net/url"
+)
+
+// MasterEntry describes one variant for BuildMaster.
+type MasterEntry struct {
+   URI              *url.URL // the variant's Media Playlist
+   Bandwidth        int64    // peak bits per second, required
+   AverageBandwidth int64
+   Resolution       string // such as "1920x1080"
+   Codecs           string
+   FrameRate        string
+}
+
+// BuildMaster returns a Master Playlist with one stream per entry, in order,
+// for tools that have Media Playlists but no master yet. Every entry needs a
+// URI and a positive Bandwidth. IDs are assigned as for a parsed playlist.
+func BuildMaster(entries []MasterEntry) (*MasterPlaylist, error) {
+   master := &MasterPlaylist{Version: 1}
+   for i, entry := range entries {
+      if entry.URI == nil {
+         return nil, fmt.Errorf("entry %d: missing URI", i)
+      }
+      if entry.Bandwidth <= 0 {
+         return nil, fmt.Errorf("entry %d (%s): missing BANDWIDTH", i, entry.URI)
+      }
+      master.StreamInfs = append(master.StreamInfs, &StreamInf{
+         URI:              entry.URI,
+         Bandwidth:        entry.Bandwidth,
+         AverageBandwidth: entry.AverageBandwidth,
+         Resolution:       entry.Resolution,
+         Codecs:           entry.Codecs,
+         FrameRate:        entry.FrameRate,
+      })
+   }
+   if len(master.StreamInfs) == 0 {
+      return nil, errors.New("no entries")
+   }
+   master.assignIDs()
+   return master, nil
+}
@@ -0,0 +1,106 @@
+package hls
+
+import (
+   "fmt"
+   "strconv"
+   "strings"
+)
+
+// avcMaxFrameSize is the maximum frame size in macroblocks for each AVC
+// level_idc, from Table A-1 of ISO/IEC 14496-10.
+var avcMaxFrameSize = []struct {
+   level int
+   size  int
+}{
+   {9, 99}, {10, 99}, {11, 396}, {12, 396}, {13, 396}, {20, 396},
+   {21, 792}, {22, 1620}, {30, 1620}, {31, 3600}, {32, 5120},
+   {40, 8192}, {41, 8192}, {42, 8704}, {50, 22080}, {51, 36864},
+   {52, 36864}, {60, 139264}, {61, 139264}, {62, 139264},
+}
+
+// hevcMaxLumaPictureSize is the maximum picture size in luma samples for each
+// HEVC general_level_idc, from Table A.8 of ITU-T H.265.
+var hevcMaxLumaPictureSize = []struct {
+   level int
+   size  int
+}{
+   {30, 36864}, {60, 122880}, {63, 245760}, {90, 552960}, {93, 983040},
+   {120, 2228224}, {123, 2228224}, {150, 8912896}, {153, 8912896},
+   {156, 8912896}, {180, 35651584}, {183, 35651584}, {186, 35651584},
+}
+
+// audioCodecs are the sample entry types of audio codecs found in CODECS.
+var audioCodecs = map[string]bool{
+   "mp4a": true, "ac-3": true, "ec-3": true, "ac-4": true, "Opus": true,
+   "opus": true, "fLaC": true, "alac": true, "dtsc": true, "dtse": true,
+   "dtsh": true, "dtsl": true, "dtsx": true, "mha1": true, "mhm1": true,
+}
+
+// textCodecs are the sample entry types of subtitle codecs found in CODECS.
+var textCodecs = map[string]bool{"wvtt": true, "stpp": true}
+
+// isAudioCodec reports whether a CODECS entry is an audio codec.
+func isAudioCodec(codec string) bool {
+   fourcc, _, _ := strings.Cut(codec, ".")
+   return audioCodecs[fourcc]
+}
+
+// isTextCodec reports whether a CODECS entry is a subtitle codec.
+func isTextCodec(codec string) bool {
+   fourcc, _, _ := strings.Cut(codec, ".")
+   return textCodecs[fourcc]
+}
+
+// codecWarning checks one codec entry against a resolution and returns a
+// warning, or "" if nothing looks wrong or the codec is not understood.
+func codecWarning(codec string, width, height int) string {
+   fourcc, rest, _ := strings.Cut(codec, ".")
+   switch fourcc {
+   case "avc1", "avc3":
+      // avc1.PPCCLL: profile_idc, constraint flags and level_idc in hex
+      if len(rest) != 6 {
+         return ""
+      }
+      profile, err := strconv.ParseUint(rest[:2], 16, 8)
+      if err != nil {
+         return ""
+      }
+      level, err := strconv.ParseUint(rest[4:], 16, 8)
+      if err != nil {
+         return ""
+      }
+      if profile == 66 && height > 1080 {
+         return fmt.Sprintf(
+            "%s: baseline profile is unlikely for %dx%d", codec, width, height,
+         )
+      }
+      frameSize := ((width + 15) / 16) * ((height + 15) / 16)
+      for _, limit := range avcMaxFrameSize {
+         if limit.level == int(level) && frameSize > limit.size {
+            return fmt.Sprintf(
+               "%s: level %d.%d is too low for %dx%d",
+               codec, level/10, level%10, width, height,
+            )
+         }
+      }
+   case "hvc1", "hev1":
+      // hvc1.P.C.TL.B...: the third field is the tier and level_idc
+      fields := strings.Split(rest, ".")
+      if len(fields) < 3 || len(fields[2]) < 2 {
+         return ""
+      }
+      level, err := strconv.Atoi(fields[2][1:])
+      if err != nil {
+         return ""
+      }
+      for _, limit := range hevcMaxLumaPictureSize {
+         if limit.level == level && width*height > limit.size {
+            return fmt.Sprintf(
+               "%s: level %g is too low for %dx%d",
+               codec, float64(level)/30, width, height,
+            )
+         }
+      }
+   }
+   return ""
+}
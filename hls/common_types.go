@@ -3,7 +3,9 @@ package hls
 import (
    "encoding/base64"
    "errors"
+   "fmt"
    "net/url"
+   "strconv"
    "strings"
 )
 
@@ -15,6 +17,15 @@ type Key struct {
    KeyFormatVersions string
    IV                string
    Characteristics   string
+   SourceLine        int // Line of the #EXT-X-KEY or #EXT-X-SESSION-KEY tag
+}
+
+// keyFormat returns KeyFormat, or "identity", its default, if it is absent.
+func (k *Key) keyFormat() string {
+   if k.KeyFormat == "" {
+      return "identity"
+   }
+   return k.KeyFormat
 }
 
 func (k *Key) resolve(base *url.URL) {
@@ -25,28 +36,112 @@ func (k *Key) resolve(base *url.URL) {
 
 // DecodeData extracts and decodes the Base64 data directly from the URL Opaque field.
 func (k *Key) DecodeData() ([]byte, error) {
-   if k.URI == nil {
-      return nil, errors.New("URI is nil")
+   _, data, err := decodeDataURI(k.URI)
+   return data, err
+}
+
+// decodeDataURI returns the media type and decoded payload of a base64 data
+// URI. The media type is lower-cased and has no parameters; it is empty if
+// the URI does not give one.
+func decodeDataURI(u *url.URL) (string, []byte, error) {
+   if u == nil {
+      return "", nil, errors.New("URI is nil")
    }
-   if k.URI.Scheme != "data" {
-      return nil, errors.New("URI is not a data URI")
+   if u.Scheme != "data" {
+      return "", nil, errors.New("URI is not a data URI")
    }
    // For data URIs, net/url stores the content (mime+encoding+data) in Opaque.
    // Format: [<mediatype>][;base64],<data>
-   meta, dataString, found := strings.Cut(k.URI.Opaque, ",")
+   meta, dataString, found := strings.Cut(u.Opaque, ",")
    if !found {
-      return nil, errors.New("invalid data URI: missing comma separator")
+      return "", nil, errors.New("invalid data URI: missing comma separator")
    }
    // Verify base64 encoding is specified in the metadata (before the comma)
    if !strings.Contains(meta, ";base64") {
-      return nil, errors.New("data URI does not contain base64 indicator")
+      return "", nil, errors.New("data URI does not contain base64 indicator")
+   }
+   mediaType, _, _ := strings.Cut(meta, ";")
+   data, err := base64.StdEncoding.DecodeString(dataString)
+   if err != nil {
+      return "", nil, err
+   }
+   return strings.ToLower(mediaType), data, nil
+}
+
+// ByteRange is a sub-range of a resource, from a BYTERANGE attribute or an
+// #EXT-X-BYTERANGE tag.
+type ByteRange struct {
+   Length int64
+   Offset int64
+}
+
+// RangeHeader returns the value of an HTTP Range header for the sub-range.
+func (b *ByteRange) RangeHeader() string {
+   return fmt.Sprintf("bytes=%d-%d", b.Offset, b.Offset+b.Length-1)
+}
+
+// parseByteRange parses the <n>[@<o>] form. hasOffset reports whether @<o>
+// was present; if not, Offset is zero.
+func parseByteRange(value string) (byteRange *ByteRange, hasOffset bool, err error) {
+   length, offset, hasOffset := strings.Cut(value, "@")
+   byteRange = &ByteRange{}
+   byteRange.Length, err = strconv.ParseInt(length, 10, 64)
+   if err != nil {
+      return nil, false, err
+   }
+   if hasOffset {
+      byteRange.Offset, err = strconv.ParseInt(offset, 10, 64)
+      if err != nil {
+         return nil, false, err
+      }
    }
-   return base64.StdEncoding.DecodeString(dataString)
+   return byteRange, hasOffset, nil
 }
 
-func parseKey(line string) *Key {
-   prefix := "#EXT-X-KEY:"
-   attrs := parseAttributes(line, prefix)
+// Map represents an initialization section from a #EXT-X-MAP tag.
+type Map struct {
+   URI       *url.URL
+   ByteRange *ByteRange // nil if the whole resource is the map
+}
+
+// Start is the preferred point to start playback, from an #EXT-X-START tag.
+type Start struct {
+   TimeOffset float64 // seconds; negative values count from the end
+   Precise    bool
+}
+
+// parseStart parses an #EXT-X-START tag. TIME-OFFSET is required.
+func parseStart(line string, strict bool) (*Start, error) {
+   attrs, err := parseAttributes(line, "#EXT-X-START:", strict)
+   if err != nil {
+      return nil, err
+   }
+   offset, err := strconv.ParseFloat(attrs["TIME-OFFSET"], 64)
+   if err != nil {
+      return nil, fmt.Errorf("invalid EXT-X-START TIME-OFFSET: %w", err)
+   }
+   return &Start{TimeOffset: offset, Precise: attrs["PRECISE"] == "YES"}, nil
+}
+
+// HTTPRange is a request for a URL, with an optional Range header value.
+type HTTPRange struct {
+   URL   *url.URL
+   Range string // such as "bytes=0-719", or empty for the whole resource
+}
+
+func (m *Map) resolve(base *url.URL) {
+   if m.URI != nil {
+      m.URI = base.ResolveReference(m.URI)
+   }
+}
+
+// parseKey parses an #EXT-X-KEY tag, or with prefix "#EXT-X-SESSION-KEY:" an
+// #EXT-X-SESSION-KEY tag, which has the same attributes.
+func parseKey(line, prefix string, opts *DecodeOptions) (*Key, error) {
+   attrs, err := parseAttributes(line, prefix, opts.Strict)
+   if err != nil {
+      return nil, err
+   }
    newKey := &Key{
       Method:            attrs["METHOD"],
       KeyFormat:         attrs["KEYFORMAT"],
@@ -55,9 +150,10 @@ func parseKey(line string) *Key {
       Characteristics:   attrs["CHARACTERISTICS"],
    }
    if value, ok := attrs["URI"]; ok && value != "" {
-      if parsedURL, err := url.Parse(value); err == nil {
-         newKey.URI = parsedURL
+      newKey.URI, err = opts.parseURI(value)
+      if err != nil {
+         return nil, err
       }
    }
-   return newKey
+   return newKey, nil
 }
@@ -0,0 +1,127 @@
+package hls
+
+import (
+   "encoding/base64"
+   "encoding/hex"
+   "errors"
+   "fmt"
+   "strconv"
+   "strings"
+   "time"
+)
+
+// DateRange represents an #EXT-X-DATERANGE tag.
+type DateRange struct {
+   ID              string
+   Class           string
+   StartDate       time.Time
+   EndDate         time.Time
+   Duration        float64
+   PlannedDuration float64
+   SCTE35Cmd       string
+   SCTE35Out       string
+   SCTE35In        string
+   EndOnNext       bool // END-ON-NEXT=YES: the range ends where the next one of its Class starts
+   SourceLine      int  // Line of the #EXT-X-DATERANGE tag
+
+   nextStart   time.Time // StartDate of the next range of the same Class
+   hasDuration bool      // DURATION was present, so 0 is a single instant
+}
+
+// EffectiveEnd returns EndDate if present, otherwise StartDate plus Duration,
+// which is StartDate itself for DURATION=0, a single instant. For an
+// END-ON-NEXT range it returns the StartDate of the following range with the
+// same Class. It returns the zero time if the range is still open, such as
+// the last END-ON-NEXT range of its Class.
+func (d *DateRange) EffectiveEnd() time.Time {
+   switch {
+   case !d.EndDate.IsZero():
+      return d.EndDate
+   case d.EndOnNext:
+      return d.nextStart
+   case d.Duration > 0, d.hasDuration && d.Duration == 0:
+      return d.StartDate.Add(secondsToDuration(d.Duration))
+   }
+   return time.Time{}
+}
+
+// linkDateRanges records, for each END-ON-NEXT range, the start of the next
+// range of the same Class in time order.
+func linkDateRanges(dateRanges []*DateRange) {
+   for _, dateRange := range dateRanges {
+      if !dateRange.EndOnNext {
+         continue
+      }
+      for _, other := range dateRanges {
+         if other.Class != dateRange.Class || !other.StartDate.After(dateRange.StartDate) {
+            continue
+         }
+         if dateRange.nextStart.IsZero() || other.StartDate.Before(dateRange.nextStart) {
+            dateRange.nextStart = other.StartDate
+         }
+      }
+   }
+}
+
+// SCTE35 decodes the first present of SCTE35-CMD, SCTE35-OUT and SCTE35-IN.
+// Values written as a 0x hexadecimal sequence, as the spec requires, are hex
+// decoded; anything else is treated as base64.
+func (d *DateRange) SCTE35() ([]byte, error) {
+   for _, value := range []string{d.SCTE35Cmd, d.SCTE35Out, d.SCTE35In} {
+      if value == "" {
+         continue
+      }
+      if hexValue, ok := strings.CutPrefix(value, "0x"); ok {
+         return hex.DecodeString(hexValue)
+      }
+      if hexValue, ok := strings.CutPrefix(value, "0X"); ok {
+         return hex.DecodeString(hexValue)
+      }
+      return base64.StdEncoding.DecodeString(value)
+   }
+   return nil, errors.New("date range has no SCTE35 attribute")
+}
+
+func parseDateRange(line string, strict bool) (*DateRange, error) {
+   attrs, err := parseAttributes(line, "#EXT-X-DATERANGE:", strict)
+   if err != nil {
+      return nil, err
+   }
+   dateRange := &DateRange{
+      ID:        attrs["ID"],
+      Class:     attrs["CLASS"],
+      SCTE35Cmd: attrs["SCTE35-CMD"],
+      SCTE35Out: attrs["SCTE35-OUT"],
+      SCTE35In:  attrs["SCTE35-IN"],
+      EndOnNext: attrs["END-ON-NEXT"] == "YES",
+   }
+   if strict && dateRange.EndOnNext && dateRange.Class == "" {
+      return nil, errors.New("EXT-X-DATERANGE with END-ON-NEXT has no CLASS")
+   }
+   if value, ok := attrs["START-DATE"]; ok {
+      dateRange.StartDate, err = time.Parse(time.RFC3339Nano, value)
+      if err != nil && strict {
+         return nil, fmt.Errorf("invalid EXT-X-DATERANGE START-DATE: %w", err)
+      }
+   }
+   if value, ok := attrs["END-DATE"]; ok {
+      dateRange.EndDate, err = time.Parse(time.RFC3339Nano, value)
+      if err != nil && strict {
+         return nil, fmt.Errorf("invalid EXT-X-DATERANGE END-DATE: %w", err)
+      }
+   }
+   if value, ok := attrs["DURATION"]; ok {
+      dateRange.Duration, err = strconv.ParseFloat(value, 64)
+      if err != nil && strict {
+         return nil, fmt.Errorf("invalid EXT-X-DATERANGE DURATION: %w", err)
+      }
+      dateRange.hasDuration = err == nil
+   }
+   if value, ok := attrs["PLANNED-DURATION"]; ok {
+      dateRange.PlannedDuration, err = strconv.ParseFloat(value, 64)
+      if err != nil && strict {
+         return nil, fmt.Errorf("invalid EXT-X-DATERANGE PLANNED-DURATION: %w", err)
+      }
+   }
+   return dateRange, nil
+}
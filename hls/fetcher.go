@@ -0,0 +1,32 @@
+package hls
+
+import (
+   "context"
+   "errors"
+   "net/url"
+)
+
+// Fetcher retrieves the content at a URL. It lets callers bring their own
+// HTTP client, with authentication, retries and so on.
+type Fetcher interface {
+   Get(ctx context.Context, u *url.URL) ([]byte, error)
+}
+
+// LoadMedia fetches the Media Playlist of stream s with f, parses it, and
+// resolves its URIs against the stream URI. The master's URIs should be
+// resolved first, so that the stream URI is absolute.
+func (mp *MasterPlaylist) LoadMedia(ctx context.Context, s *StreamInf, f Fetcher) (*MediaPlaylist, error) {
+   if s.URI == nil {
+      return nil, errors.New("stream has no URI")
+   }
+   data, err := f.Get(ctx, s.URI)
+   if err != nil {
+      return nil, err
+   }
+   media, err := DecodeMediaBytes(data)
+   if err != nil {
+      return nil, err
+   }
+   media.ResolveURIs(s.URI)
+   return media, nil
+}
@@ -1,11 +1,17 @@
 package hls
 
 import (
+   "bytes"
+   "context"
+   "fmt"
+   "net/http"
+   "net/http/httptest"
    "net/url"
    "os"
    "path/filepath"
    "strings"
    "testing"
+   "time"
 )
 
 const (
@@ -58,6 +64,9 @@ func TestDecodeMaster(t *testing.T) {
    if err != nil {
       t.Fatalf("DecodeMaster failed: %v", err)
    }
+   if master.Version != 1 {
+      t.Errorf("Expected default version 1, got %d", master.Version)
+   }
    // The sample manifest has 8 unique video stream URIs.
    if len(master.StreamInfs) != 8 {
       t.Errorf("Expected 8 unique streams, got %d", len(master.StreamInfs))
@@ -93,3 +102,2611 @@ func TestDecodeMaster(t *testing.T) {
       t.Logf("%s\n---", stream)
    }
 }
+
+func TestDecodeMediaBytes(t *testing.T) {
+   data, err := os.ReadFile(filepath.Join("../testdata", mediaFilename))
+   if err != nil {
+      t.Fatal(err)
+   }
+   fromString, err := DecodeMedia(string(data))
+   if err != nil {
+      t.Fatal(err)
+   }
+   fromBytes, err := DecodeMediaBytes(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(fromBytes.Segments) != len(fromString.Segments) {
+      t.Fatalf("Expected %d segments, got %d", len(fromString.Segments), len(fromBytes.Segments))
+   }
+   for i, segment := range fromBytes.Segments {
+      if segment.URI.String() != fromString.Segments[i].URI.String() {
+         t.Errorf("Segment %d: expected %s, got %s", i, fromString.Segments[i].URI, segment.URI)
+      }
+   }
+}
+
+func BenchmarkDecodeMedia(b *testing.B) {
+   data, err := os.ReadFile(filepath.Join("../testdata", mediaFilename))
+   if err != nil {
+      b.Fatal(err)
+   }
+   b.Run("string", func(b *testing.B) {
+      b.ReportAllocs()
+      for range b.N {
+         if _, err := DecodeMedia(string(data)); err != nil {
+            b.Fatal(err)
+         }
+      }
+   })
+   b.Run("bytes", func(b *testing.B) {
+      b.ReportAllocs()
+      for range b.N {
+         if _, err := DecodeMediaBytes(data); err != nil {
+            b.Fatal(err)
+         }
+      }
+   })
+   b.Run("detect", func(b *testing.B) {
+      b.ReportAllocs()
+      for range b.N {
+         if _, _, err := DetectType(bytes.NewReader(data)); err != nil {
+            b.Fatal(err)
+         }
+      }
+   })
+}
+
+func TestDecodeMediaMultipleMaps(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-MAP:URI="init-a.mp4"
+#EXTINF:6,
+a1.m4s
+#EXTINF:6,
+a2.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init-b.mp4"
+#EXTINF:6,
+b1.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="init-a.mp4"
+#EXTINF:6,
+a3.m4s
+#EXT-X-ENDLIST`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(media.Maps) != 2 {
+      t.Fatalf("Expected 2 distinct maps, got %d", len(media.Maps))
+   }
+   expected := []string{"init-a.mp4", "init-a.mp4", "init-b.mp4", "init-a.mp4"}
+   for i, segment := range media.Segments {
+      if segment.Map == nil || segment.Map.URI.String() != expected[i] {
+         t.Errorf("Segment %d: expected map %s, got %v", i, expected[i], segment.Map)
+      }
+   }
+   media.ResolveURIs(&url.URL{Scheme: "https", Host: "example.com", Path: "/v/"})
+   if got := media.Segments[2].Map.URI.String(); got != "https://example.com/v/init-b.mp4" {
+      t.Errorf("Expected resolved map URI, got %s", got)
+   }
+}
+
+func TestDuplicateAttribute(t *testing.T) {
+   const content = `#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1000,RESOLUTION=640x360,RESOLUTION=1920x1080
+low.m3u8`
+   master, err := DecodeMaster(content)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if got := master.StreamInfs[0].Resolution; got != "640x360" {
+      t.Errorf("Expected first RESOLUTION to win, got %s", got)
+   }
+   strict := DecodeOptions{Strict: true}
+   if _, err := strict.DecodeMaster(content); err == nil {
+      t.Error("Expected strict mode to reject duplicate RESOLUTION")
+   }
+}
+
+func TestDecodeMediaIndented(t *testing.T) {
+   const content = "#EXTM3U\n" +
+      "  #EXT-X-VERSION:3\n" +
+      "\t#EXT-X-TARGETDURATION:10 \n" +
+      " \t#EXTINF:9.5,\t\n" +
+      "    segment 1.ts  \n" +
+      "#EXT-X-ENDLIST\t\n"
+   for _, decode := range []func() (*MediaPlaylist, error){
+      func() (*MediaPlaylist, error) { return DecodeMedia(content) },
+      func() (*MediaPlaylist, error) { return DecodeMediaBytes([]byte(content)) },
+   } {
+      media, err := decode()
+      if err != nil {
+         t.Fatal(err)
+      }
+      if media.Version != 3 || media.TargetDuration != 10 || !media.EndList {
+         t.Errorf("Indented tags not parsed: %+v", media)
+      }
+      if len(media.Segments) != 1 || media.Segments[0].URI.Path != "segment 1.ts" {
+         t.Errorf("Expected URI with inner space preserved, got %+v", media.Segments)
+      }
+   }
+}
+
+func TestRewritePaths(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-MAP:URI="https://cdn.example.com/a%2Fb/init.ts?token=1"
+#EXTINF:6,
+https://cdn.example.com/a%2Fb/seg%201.ts?token=2
+#EXT-X-ENDLIST`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   media.RewritePaths(func(path string) string {
+      return strings.TrimSuffix(path, ".ts") + ".m4s"
+   })
+   expected := "https://cdn.example.com/a%2Fb/seg%201.m4s?token=2"
+   if got := media.Segments[0].URI.String(); got != expected {
+      t.Errorf("Expected %s, got %s", expected, got)
+   }
+   expected = "https://cdn.example.com/a%2Fb/init.m4s?token=1"
+   if got := media.Map.String(); got != expected {
+      t.Errorf("Expected %s, got %s", expected, got)
+   }
+   if got := media.Maps[0].URI.String(); got != expected {
+      t.Errorf("Expected %s, got %s", expected, got)
+   }
+}
+
+func TestDecodeFromResponse(t *testing.T) {
+   mux := http.NewServeMux()
+   mux.HandleFunc("/old/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+      http.Redirect(w, r, "/new/master.m3u8", http.StatusFound)
+   })
+   mux.HandleFunc("/new/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+      w.Write([]byte("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nlow.m3u8\n"))
+   })
+   server := httptest.NewServer(mux)
+   defer server.Close()
+
+   resp, err := http.Get(server.URL + "/old/master.m3u8")
+   if err != nil {
+      t.Fatal(err)
+   }
+   playlist, err := DecodeFromResponse(resp)
+   if err != nil {
+      t.Fatal(err)
+   }
+   master, ok := playlist.(*MasterPlaylist)
+   if !ok {
+      t.Fatalf("Expected *MasterPlaylist, got %T", playlist)
+   }
+   expected := server.URL + "/new/low.m3u8"
+   if got := master.StreamInfs[0].URI.String(); got != expected {
+      t.Errorf("Expected %s, got %s", expected, got)
+   }
+}
+
+func TestSessionData(t *testing.T) {
+   const content = `#EXTM3U
+#EXT-X-SESSION-DATA:DATA-ID="com.example.title",VALUE="Movie",URI="title.json"
+#EXT-X-STREAM-INF:BANDWIDTH=1000
+low.m3u8`
+   master, err := DecodeMaster(content)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if data := master.SessionData[0]; data.HasURI() || data.Value != "Movie" {
+      t.Errorf("Expected lenient parse to keep VALUE, got %+v", data)
+   }
+   strict := DecodeOptions{Strict: true}
+   _, err = strict.DecodeMaster(content)
+   if err == nil || !strings.Contains(err.Error(), "com.example.title") {
+      t.Errorf("Expected error naming the DATA-ID, got %v", err)
+   }
+}
+
+func TestDateRangeSCTE35(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-DATERANGE:ID="a",START-DATE="2024-01-01T00:00:00Z",SCTE35-OUT=0xFC3025
+#EXT-X-DATERANGE:ID="b",START-DATE="2024-01-01T00:00:30Z",SCTE35-IN="/DAl"
+#EXT-X-DATERANGE:ID="c",START-DATE="2024-01-01T00:01:00Z",DURATION=30.0
+#EXTINF:6,
+a.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   expected := []byte{0xFC, 0x30, 0x25}
+   for _, dateRange := range media.DateRanges[:2] {
+      data, err := dateRange.SCTE35()
+      if err != nil {
+         t.Fatal(err)
+      }
+      if string(data) != string(expected) {
+         t.Errorf("%s: expected %x, got %x", dateRange.ID, expected, data)
+      }
+   }
+   if _, err := media.DateRanges[2].SCTE35(); err == nil {
+      t.Error("Expected error for date range without SCTE35")
+   }
+}
+
+func TestSegmentStartTime(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:7
+#EXT-X-MEDIA-SEQUENCE:100
+#EXTINF:6.006,
+a.ts
+#EXTINF:5.5,
+b.ts
+#EXTINF:6,
+c.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   segments := media.Segments
+   if segments[0].StartTime != 0 {
+      t.Errorf("Expected first segment to start at 0, got %v", segments[0].StartTime)
+   }
+   expected := segments[0].Duration + segments[1].Duration
+   if segments[2].StartTime != expected {
+      t.Errorf("Expected third segment to start at %v, got %v", expected, segments[2].StartTime)
+   }
+}
+
+func TestDecodeMediaMulti(t *testing.T) {
+   const content = `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXTINF:6,
+a.ts
+#EXT-X-ENDLIST
+#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4,
+b.ts
+#EXTINF:4,
+c.ts
+#EXT-X-ENDLIST`
+   playlists, err := DecodeMediaMulti(strings.NewReader(content))
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(playlists) != 2 {
+      t.Fatalf("Expected 2 playlists, got %d", len(playlists))
+   }
+   if playlists[1].TargetDuration != 4 || len(playlists[1].Segments) != 2 {
+      t.Errorf("Second playlist parsed incorrectly: %+v", playlists[1])
+   }
+   strict := DecodeOptions{Strict: true}
+   if _, err := strict.DecodeMedia(content); err == nil {
+      t.Error("Expected strict DecodeMedia to reject a second #EXTM3U")
+   }
+}
+
+func TestDecodeMasterDeterministicIDs(t *testing.T) {
+   a, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",URI="en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=2000,AUDIO="aud"
+high.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO="aud"
+low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   b, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO="aud"
+low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2000,AUDIO="aud"
+high.m3u8
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",URI="en.m3u8"`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   ids := func(mp *MasterPlaylist) map[string]int {
+      result := map[string]int{}
+      for _, stream := range mp.StreamInfs {
+         result[stream.URI.String()] = stream.ID
+      }
+      for _, media := range mp.Medias {
+         result[media.URI.String()] = media.ID
+      }
+      return result
+   }
+   idsA, idsB := ids(a), ids(b)
+   for uri, id := range idsA {
+      if idsB[uri] != id {
+         t.Errorf("%s: ID %d in one order, %d in the other", uri, id, idsB[uri])
+      }
+   }
+}
+
+func TestSourceLine(t *testing.T) {
+   const content = "#EXTM3U\n\n#EXT-X-TARGETDURATION:6\n\n#EXTINF:6,\na.ts\n\n\n#EXTINF:6,\nb.ts\n"
+   media, err := DecodeMedia(content)
+   if err != nil {
+      t.Fatal(err)
+   }
+   fromBytes, err := DecodeMediaBytes([]byte(content))
+   if err != nil {
+      t.Fatal(err)
+   }
+   for i, expected := range []int{5, 9} {
+      if got := media.Segments[i].SourceLine; got != expected {
+         t.Errorf("Segment %d: expected line %d, got %d", i, expected, got)
+      }
+      if got := fromBytes.Segments[i].SourceLine; got != expected {
+         t.Errorf("Segment %d from bytes: expected line %d, got %d", i, expected, got)
+      }
+   }
+}
+
+func TestCodecResolutionWarnings(t *testing.T) {
+   tests := []struct {
+      codecs     string
+      resolution string
+      warnings   int
+   }{
+      {"avc1.640028,mp4a.40.2", "1920x1080", 0},
+      {"avc1.64001f,mp4a.40.2", "1920x1080", 1},
+      {"avc1.42e033", "3840x2160", 1},
+      {"hvc1.2.4.L150.90", "3840x2160", 0},
+      {"hvc1.2.4.L120.90", "3840x2160", 1},
+   }
+   for _, test := range tests {
+      stream := &StreamInf{Codecs: test.codecs, Resolution: test.resolution}
+      warnings := stream.CodecResolutionWarnings()
+      if len(warnings) != test.warnings {
+         t.Errorf("%s at %s: expected %d warnings, got %q", test.codecs, test.resolution, test.warnings, warnings)
+      }
+   }
+}
+
+func TestSequenceGaps(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00Z
+#EXTINF:6,
+a.ts
+#EXTINF:6,
+b.ts
+#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:12Z
+#EXTINF:6,
+c.ts
+#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:24Z
+#EXTINF:6,
+e.ts
+#EXT-X-DISCONTINUITY
+#EXT-X-PROGRAM-DATE-TIME:2024-01-01T01:00:00Z
+#EXTINF:6,
+ad.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   gaps := media.SequenceGaps()
+   if len(gaps) != 1 || gaps[0] != 3 {
+      t.Errorf("Expected a gap before segment 3, got %v", gaps)
+   }
+}
+
+func TestLowercaseAttributes(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:type=AUDIO,group-id="aud",name="English",uri="en.m3u8"
+#EXT-X-STREAM-INF:bandwidth=1000,resolution=640x360,Audio="aud"
+low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   stream := master.StreamInfs[0]
+   if stream.Bandwidth != 1000 || stream.Resolution != "640x360" || len(stream.Audio) != 1 {
+      t.Errorf("Lowercase attributes not resolved: %+v", stream)
+   }
+   if media := master.Medias[0]; media.GroupID != "aud" || media.URI == nil {
+      t.Errorf("Lowercase attributes not resolved: %+v", media)
+   }
+}
+
+func TestContentAfterEndList(t *testing.T) {
+   const content = `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXTINF:6,
+a.ts
+#EXT-X-ENDLIST
+#EXTINF:6,
+phantom.ts`
+   media, err := DecodeMedia(content)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(media.Segments) != 1 || !media.EndList {
+      t.Errorf("Expected parsing to stop at ENDLIST, got %d segments", len(media.Segments))
+   }
+   strict := DecodeOptions{Strict: true}
+   if _, err := strict.DecodeMedia(content); err == nil {
+      t.Error("Expected strict mode to reject content after ENDLIST")
+   }
+}
+
+func TestResolveURIsAbsolute(t *testing.T) {
+   base, err := url.Parse("https://example.com/a/b/master.m3u8")
+   if err != nil {
+      t.Fatal(err)
+   }
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-SESSION-DATA:DATA-ID="com.example.info",URI="info.json"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",URI="audio/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO="aud"
+video/low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   master.ResolveURIs(base)
+   masterURIs := []*url.URL{
+      master.SessionData[0].URI, master.Medias[0].URI, master.StreamInfs[0].URI,
+   }
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:6,
+seg.m4s`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   media.ResolveURIs(base)
+   mediaURIs := []*url.URL{
+      media.Keys[0].URI, media.Map, media.Maps[0].URI,
+      media.Segments[0].Map.URI, media.Segments[0].URI,
+   }
+   for i, uri := range append(masterURIs, mediaURIs...) {
+      if uri == nil || !uri.IsAbs() {
+         t.Errorf("URI %d is not absolute: %v", i, uri)
+      }
+   }
+}
+
+func TestValidateTargetDuration(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXTINF:6.4,
+a.ts
+#EXTINF:6.6,
+b.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if got := media.MaxSegmentDuration(); got != 6.6 {
+      t.Errorf("Expected max duration 6.6, got %v", got)
+   }
+   err = media.Validate()
+   if err == nil || !strings.Contains(err.Error(), "segment 1 (line 5)") {
+      t.Errorf("Expected error naming segment 1, got %v", err)
+   }
+}
+
+func TestValidateDefaultRendition(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="English",DEFAULT=YES,AUTOSELECT=YES,URI="en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="French",AUTOSELECT=YES,URI="fr.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="b",NAME="English",DEFAULT=YES,URI="en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="b",NAME="French",DEFAULT=YES,AUTOSELECT=YES,URI="fr.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO="a"
+low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if media := master.DefaultRendition("a"); media == nil || media.Name != "English" {
+      t.Errorf("Expected English default in group a, got %v", media)
+   }
+   if media := master.DefaultRendition("b"); media != nil {
+      t.Errorf("Expected no default for ambiguous group b, got %v", media)
+   }
+   err = master.Validate()
+   if err == nil {
+      t.Fatal("Expected validation errors")
+   }
+   for _, expected := range []string{"requires AUTOSELECT=YES", "more than one DEFAULT=YES"} {
+      if !strings.Contains(err.Error(), expected) {
+         t.Errorf("Expected %q in %v", expected, err)
+      }
+   }
+}
+
+func TestTrimLadder(t *testing.T) {
+   data, err := os.ReadFile(filepath.Join("../testdata", masterFilename))
+   if err != nil {
+      t.Fatal(err)
+   }
+   master, err := DecodeMaster(string(data))
+   if err != nil {
+      t.Fatal(err)
+   }
+   if trimmed := master.TrimLadder(1, 1); len(trimmed.StreamInfs) != 2 {
+      t.Fatalf("Expected 2 streams, got %d", len(trimmed.StreamInfs))
+   }
+   trimmed := master.TrimLadder(1, 0)
+   for _, media := range trimmed.Medias {
+      if media.GroupID == "aac-128k" {
+         t.Errorf("Expected aac-128k group to be pruned")
+      }
+   }
+   if len(master.StreamInfs) != 8 {
+      t.Errorf("Original playlist was modified")
+   }
+   if kept := master.TrimLadder(0, 0); len(kept.StreamInfs) != 1 {
+      t.Errorf("Expected at least one stream to be kept, got %d", len(kept.StreamInfs))
+   }
+}
+
+func TestGluedExtinf(t *testing.T) {
+   const content = `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXTINF:6.0,segment1.ts
+#EXTINF:6.0,Chapter One
+segment2.ts
+#EXTINF:6.0,Intro
+#EXT-X-ENDLIST`
+   media, err := DecodeMedia(content)
+   if err != nil {
+      t.Fatal(err)
+   }
+   segments := media.Segments
+   if segments[0].URI == nil || segments[0].URI.String() != "segment1.ts" || segments[0].Title != "" {
+      t.Errorf("Expected glued URI to be recovered, got %+v", segments[0])
+   }
+   if segments[1].URI.String() != "segment2.ts" || segments[1].Title != "Chapter One" {
+      t.Errorf("Expected normal segment, got %+v", segments[1])
+   }
+   if segments[2].URI != nil || segments[2].Title != "Intro" {
+      t.Errorf("Expected plain title to be kept, got %+v", segments[2])
+   }
+   strict := DecodeOptions{Strict: true}
+   media, err = strict.DecodeMedia(content)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if media.Segments[0].URI != nil {
+      t.Error("Expected strict mode not to recover glued URI")
+   }
+
+   // A title that looks like a URI is kept when the URI follows a tag
+   media, err = DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4,seg0.ts
+#EXT-X-BYTERANGE:100@0
+main.ts
+#EXTINF:4,
+#EXT-X-BYTERANGE:50
+main.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   segments = media.Segments
+   if len(segments) != 2 {
+      t.Fatalf("Expected 2 segments, got %d", len(segments))
+   }
+   if segments[0].URI.String() != "main.ts" || segments[0].Title != "seg0.ts" {
+      t.Errorf("Expected main.ts titled seg0.ts, got %+v", segments[0])
+   }
+   if segments[0].ByteRange == nil || *segments[0].ByteRange != (ByteRange{Length: 100, Offset: 0}) {
+      t.Errorf("Expected 100@0, got %+v", segments[0].ByteRange)
+   }
+   if segments[1].ByteRange == nil || *segments[1].ByteRange != (ByteRange{Length: 50, Offset: 100}) {
+      t.Errorf("Expected 50@100, got %+v", segments[1].ByteRange)
+   }
+}
+
+func TestInterpolateProgramDateTime(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXTINF:4,
+a.ts
+#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:10Z
+#EXTINF:6,
+b.ts
+#EXTINF:6,
+c.ts
+#EXT-X-DISCONTINUITY
+#EXTINF:6,
+d.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   media.InterpolateProgramDateTime()
+   expected := []string{"2024-01-01T00:00:06Z", "2024-01-01T00:00:10Z", "2024-01-01T00:00:16Z"}
+   for i, value := range expected {
+      if got := media.Segments[i].ProgramDateTime.Format(time.RFC3339); got != value {
+         t.Errorf("Segment %d: expected %s, got %s", i, value, got)
+      }
+   }
+   if !media.Segments[3].ProgramDateTime.IsZero() {
+      t.Error("Expected no interpolation across the discontinuity")
+   }
+}
+
+func TestOnUnrecognized(t *testing.T) {
+   var ignored []int
+   options := DecodeOptions{
+      OnUnrecognized: func(line string, num int) {
+         ignored = append(ignored, num)
+      },
+   }
+   _, err := options.DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATON:6
+# a comment
+#EXTINF:6,
+a.ts
+stray.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(ignored) != 2 || ignored[0] != 2 || ignored[1] != 6 {
+      t.Errorf("Expected lines 2 and 6 to be reported, got %v", ignored)
+   }
+}
+
+func TestStreamInfGroupingAverageBandwidth(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=2000,AVERAGE-BANDWIDTH=1800,CODECS="avc1.640028,ec-3",AUDIO="eac-3"
+video.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2000,AVERAGE-BANDWIDTH=1200,CODECS="avc1.640028,mp4a.40.2",AUDIO="aac"
+video.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   stream := master.StreamInfs[0]
+   if stream.AverageBandwidth != 1200 || stream.Codecs != "avc1.640028,mp4a.40.2" {
+      t.Errorf("Expected the lower AVERAGE-BANDWIDTH variant to win, got %+v", stream)
+   }
+}
+
+func TestInitSegmentRequests(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-MAP:URI="main.mp4",BYTERANGE="720@0"
+#EXTINF:6,
+a.m4s
+#EXT-X-DISCONTINUITY
+#EXT-X-MAP:URI="ad.mp4"
+#EXTINF:6,
+b.m4s`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   requests := media.InitSegmentRequests()
+   if len(requests) != 2 {
+      t.Fatalf("Expected 2 requests, got %d", len(requests))
+   }
+   if requests[0].URL.String() != "main.mp4" || requests[0].Range != "bytes=0-719" {
+      t.Errorf("Unexpected first request %+v", requests[0])
+   }
+   if requests[1].URL.String() != "ad.mp4" || requests[1].Range != "" {
+      t.Errorf("Unexpected second request %+v", requests[1])
+   }
+}
+
+func TestRegisterTagHandler(t *testing.T) {
+   var options DecodeOptions
+   var cues []string
+   options.RegisterTagHandler("#EXT-X-VENDOR-CUE:", func(attrs map[string]string, mp *MediaPlaylist) {
+      cues = append(cues, attrs["ID"])
+   })
+   options.OnUnrecognized = func(line string, num int) {
+      t.Errorf("Line %d should have been handled: %s", num, line)
+   }
+   _, err := options.DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXT-X-VENDOR-CUE:ID="one",TYPE=AD
+#EXTINF:6,
+a.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(cues) != 1 || cues[0] != "one" {
+      t.Errorf("Expected handler to receive ID one, got %v", cues)
+   }
+}
+
+func TestDiffLadder(t *testing.T) {
+   a, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1000,RESOLUTION=640x360,CODECS="avc1.64001e"
+a/low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=3000,RESOLUTION=1280x720,CODECS="avc1.64001f"
+a/mid.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=6000,RESOLUTION=1920x1080,CODECS="avc1.640028"
+a/high.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   b, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=3500,RESOLUTION=1280x720,CODECS="avc1.64001f"
+b/mid.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1000,RESOLUTION=640x360,CODECS="avc1.64001e"
+b/low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=12000,RESOLUTION=3840x2160,CODECS="hvc1.2.4.L150.90"
+b/uhd.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   expected := []string{
+      "add bandwidth=12000 resolution=3840x2160 codecs=hvc1.2.4.L150.90",
+      "change bandwidth=3000 resolution=1280x720 codecs=avc1.64001f -> bandwidth=3500",
+      "remove bandwidth=6000 resolution=1920x1080 codecs=avc1.640028",
+   }
+   diffs := a.DiffLadder(b)
+   if strings.Join(diffs, "\n") != strings.Join(expected, "\n") {
+      t.Errorf("Expected %q, got %q", expected, diffs)
+   }
+   if diffs := a.DiffLadder(a); len(diffs) != 0 {
+      t.Errorf("Expected no differences, got %q", diffs)
+   }
+}
+
+func TestMediaVersion(t *testing.T) {
+   const content = `#EXTM3U
+#EXT-X-TARGETDURATION:6
+#EXTINF:5.5,
+a.ts`
+   media, err := DecodeMedia(content)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if media.Version != 1 {
+      t.Errorf("Expected default version 1, got %d", media.Version)
+   }
+   if media.VersionRequired() != 3 {
+      t.Errorf("Expected decimal EXTINF to require version 3, got %d", media.VersionRequired())
+   }
+   strict := DecodeOptions{Strict: true}
+   if _, err := strict.DecodeMedia(content); err == nil {
+      t.Error("Expected strict mode to reject version 1 with decimal EXTINF")
+   }
+}
+
+func TestApplyMasterDefaults(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-START:TIME-OFFSET=-12.5,PRECISE=YES
+#EXT-X-STREAM-INF:BANDWIDTH=1000
+low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   media, err := DecodeMedia("#EXTM3U\n#EXTINF:4,\na.ts")
+   if err != nil {
+      t.Fatal(err)
+   }
+   if media.IndependentSegments || media.Start != nil {
+      t.Fatal("Expected no defaults before applying the master")
+   }
+   media.ApplyMasterDefaults(master)
+   if !media.IndependentSegments {
+      t.Error("Expected IndependentSegments from the master")
+   }
+   if media.Start == nil || media.Start.TimeOffset != -12.5 || !media.Start.Precise {
+      t.Errorf("Expected the master's start, got %+v", media.Start)
+   }
+}
+
+func TestStreamsUsingGroup(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",URI="en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",URI="subs.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO="aud"
+low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2000,AUDIO="aud",SUBTITLES="subs"
+high.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if streams := master.StreamsUsingGroup("aud"); len(streams) != 2 {
+      t.Errorf("Expected 2 streams using aud, got %d", len(streams))
+   }
+   streams := master.StreamsUsingGroup("subs")
+   if len(streams) != 1 || streams[0].URI.String() != "high.m3u8" {
+      t.Errorf("Expected only high.m3u8 to use subs, got %v", streams)
+   }
+   if streams := master.StreamsUsingGroup("cc"); len(streams) != 0 {
+      t.Errorf("Expected no streams using cc, got %d", len(streams))
+   }
+}
+
+func TestLegacyExtinf(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:10
+#EXTINF:10
+a.ts
+#EXTINF:10 ,title
+b.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(media.Segments) != 2 {
+      t.Fatalf("Expected 2 segments, got %d", len(media.Segments))
+   }
+   for _, segment := range media.Segments {
+      if segment.Duration != 10 {
+         t.Errorf("Expected duration 10, got %v", segment.Duration)
+      }
+   }
+   if media.Segments[1].Title != "title" {
+      t.Errorf("Expected title, got %q", media.Segments[1].Title)
+   }
+   if media.Segments[1].RawDuration != "10" {
+      t.Errorf("Expected raw duration 10, got %q", media.Segments[1].RawDuration)
+   }
+}
+
+func TestAllCodecs(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1000,CODECS="avc1.64001f,mp4a.40.2"
+low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2000,CODECS="hvc1.2.4.L150.90, mp4a.40.2"
+high.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   expected := "avc1.64001f,hvc1.2.4.L150.90,mp4a.40.2"
+   if codecs := strings.Join(master.AllCodecs(), ","); codecs != expected {
+      t.Errorf("Expected %s, got %s", expected, codecs)
+   }
+}
+
+func TestCharacteristicList(t *testing.T) {
+   media := &Media{
+      Characteristics: "public.accessibility.transcribes-spoken-dialog, public.easy-to-read",
+   }
+   list := media.CharacteristicList()
+   if len(list) != 2 || list[1] != "public.easy-to-read" {
+      t.Errorf("Expected 2 trimmed characteristics, got %q", list)
+   }
+   if !media.HasCharacteristic("public.easy-to-read") {
+      t.Error("Expected public.easy-to-read")
+   }
+   if media.HasCharacteristic("public.accessibility.describes-video") {
+      t.Error("Expected no public.accessibility.describes-video")
+   }
+}
+
+func TestDuplicateURIs(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:4
+#EXTINF:4,
+a.ts
+#EXTINF:4,
+a.ts
+#EXT-X-BYTERANGE:1000@0
+#EXTINF:4,
+b.ts
+#EXT-X-BYTERANGE:1000
+#EXTINF:4,
+b.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if offset := media.Segments[3].ByteRange.Offset; offset != 1000 {
+      t.Errorf("Expected the second range to start at 1000, got %d", offset)
+   }
+   duplicates := media.DuplicateURIs()
+   if len(duplicates) != 1 || len(duplicates[0]) != 2 || duplicates[0][1] != 1 {
+      t.Errorf("Expected only segments 0 and 1 to be duplicates, got %v", duplicates)
+   }
+   if err := media.Validate(); err == nil || !strings.Contains(err.Error(), "duplicate URI") {
+      t.Errorf("Expected Validate to report the duplicate, got %v", err)
+   }
+}
+
+func TestNonGapSegments(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4,
+a.ts
+#EXT-X-GAP
+#EXTINF:4,
+b.ts
+#EXTINF:4,
+c.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   segments := media.NonGapSegments()
+   if len(segments) != 2 {
+      t.Fatalf("Expected 2 segments, got %d", len(segments))
+   }
+   if segments[1].URI.String() != "c.ts" {
+      t.Errorf("Expected c.ts after the gap, got %s", segments[1].URI)
+   }
+   // The gap still takes up time on the timeline
+   if segments[1].StartTime != 8 {
+      t.Errorf("Expected c.ts to start at 8, got %v", segments[1].StartTime)
+   }
+   if len(media.Segments) != 3 {
+      t.Errorf("Expected Segments to keep the gap, got %d", len(media.Segments))
+   }
+}
+
+func TestHasClosedCaptions(t *testing.T) {
+   for value, expected := range map[string]bool{"": false, "NONE": false, "cc": true} {
+      stream := &StreamInf{ClosedCaptions: value}
+      if stream.HasClosedCaptions() != expected {
+         t.Errorf("CLOSED-CAPTIONS %q: expected %v", value, expected)
+      }
+   }
+}
+
+type mapFetcher map[string]string
+
+func (m mapFetcher) Get(ctx context.Context, u *url.URL) ([]byte, error) {
+   content, ok := m[u.String()]
+   if !ok {
+      return nil, fmt.Errorf("%s not found", u)
+   }
+   return []byte(content), nil
+}
+
+func TestLoadMedia(t *testing.T) {
+   master, err := DecodeMaster("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1000\nvideo/low.m3u8")
+   if err != nil {
+      t.Fatal(err)
+   }
+   base, _ := url.Parse("https://example.com/show/master.m3u8")
+   master.ResolveURIs(base)
+   fetcher := mapFetcher{
+      "https://example.com/show/video/low.m3u8": "#EXTM3U\n#EXTINF:4,\nseg0.ts",
+   }
+   media, err := master.LoadMedia(context.Background(), master.StreamInfs[0], fetcher)
+   if err != nil {
+      t.Fatal(err)
+   }
+   expected := "https://example.com/show/video/seg0.ts"
+   if uri := media.Segments[0].URI.String(); uri != expected {
+      t.Errorf("Expected %s, got %s", expected, uri)
+   }
+}
+
+func TestWindowDuration(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-MEDIA-SEQUENCE:100
+#EXTINF:4.5,
+a.ts
+#EXTINF:4,
+b.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if window := media.WindowDuration(); window != 8500*time.Millisecond {
+      t.Errorf("Expected 8.5s, got %v", window)
+   }
+}
+
+func TestLanguageMatches(t *testing.T) {
+   media := &Media{Language: "en-US"}
+   for _, pref := range []string{"en", "EN-gb", "eng"} {
+      if !media.LanguageMatches(pref) {
+         t.Errorf("Expected en-US to match %q", pref)
+      }
+   }
+   if media.LanguageMatches("fr") {
+      t.Error("Expected en-US not to match fr")
+   }
+   if (&Media{Language: "ger"}).LanguageMatches("de-AT") != true {
+      t.Error("Expected ger to match de-AT")
+   }
+   if (&Media{}).LanguageMatches("") {
+      t.Error("Expected no LANGUAGE to match nothing")
+   }
+}
+
+func TestSplitByVideoCodec(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-SESSION-KEY:METHOD=SAMPLE-AES,URI="skd://key",KEYFORMAT="com.apple.streamingkeydelivery"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",URI="aac.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="ec3",NAME="English",URI="ec3.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,CODECS="avc1.64001f,mp4a.40.2",AUDIO="aac"
+avc.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2000,CODECS="hvc1.2.4.L150.90,ec-3",AUDIO="ec3"
+hevc.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=100,CODECS="avc1.64001f",URI="avc-iframe.m3u8"
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=200,CODECS="hvc1.2.4.L150.90",URI="hevc-iframe.m3u8"`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   split := master.SplitByVideoCodec()
+   if len(split) != 2 {
+      t.Fatalf("Expected 2 playlists, got %d", len(split))
+   }
+   hevc := split["hvc1"]
+   if hevc == nil || len(hevc.StreamInfs) != 1 || hevc.StreamInfs[0].URI.String() != "hevc.m3u8" {
+      t.Fatalf("Expected hvc1 to hold hevc.m3u8, got %+v", hevc)
+   }
+   if len(hevc.Medias) != 1 || hevc.Medias[0].GroupID != "ec3" {
+      t.Errorf("Expected only the ec3 group, got %d renditions", len(hevc.Medias))
+   }
+   if len(hevc.SessionKeys) != 1 {
+      t.Errorf("Expected the session key to be kept, got %d", len(hevc.SessionKeys))
+   }
+   for fourcc, uri := range map[string]string{"avc1": "avc-iframe.m3u8", "hvc1": "hevc-iframe.m3u8"} {
+      frames := split[fourcc].IFrameStreams
+      if len(frames) != 1 || frames[0].URI.String() != uri {
+         t.Errorf("Expected %s to advertise only %s, got %v", fourcc, uri, frames)
+      }
+   }
+}
+
+func TestByteRangeOffsets(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:4
+#EXT-X-BYTERANGE:1000@500
+#EXTINF:4,
+a.mp4
+#EXT-X-BYTERANGE:2000
+#EXTINF:4,
+a.mp4
+#EXT-X-BYTERANGE:300
+#EXTINF:4,
+b.mp4
+#EXT-X-BYTERANGE:400
+#EXTINF:4,
+b.mp4
+#EXT-X-BYTERANGE:100
+#EXTINF:4,
+a.mp4`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   expected := []string{
+      "bytes=500-1499",
+      "bytes=1500-3499",
+      "bytes=0-299",
+      "bytes=300-699",
+      "bytes=3500-3599",
+   }
+   for i, segment := range media.Segments {
+      if header := segment.ByteRange.RangeHeader(); header != expected[i] {
+         t.Errorf("segment %d: expected %s, got %s", i, expected[i], header)
+      }
+   }
+}
+
+func TestResolvedSegments(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-MEDIA-SEQUENCE:7
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4,
+a.mp4
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXTINF:4,
+b.mp4
+#EXT-X-KEY:METHOD=AES-128,URI="key2.bin",IV=0x0102
+#EXT-X-DISCONTINUITY
+#EXTINF:4,
+c.mp4`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   segments := media.ResolvedSegments()
+   if segments[0].Key != nil || segments[0].Map == nil {
+      t.Errorf("Expected the first segment unencrypted with a map, got %+v", segments[0])
+   }
+   if segments[1].SequenceNumber != 8 || segments[1].Key.URI.String() != "key.bin" {
+      t.Errorf("Expected sequence 8 with key.bin, got %+v", segments[1])
+   }
+   if segments[1].IV != "0x00000000000000000000000000000008" {
+      t.Errorf("Expected the IV implied by the sequence number, got %s", segments[1].IV)
+   }
+   if segments[2].IV != "0x0102" || !segments[2].Discontinuity {
+      t.Errorf("Expected the explicit IV and a discontinuity, got %+v", segments[2])
+   }
+}
+
+func TestResolvedSegmentsMultiDRM(t *testing.T) {
+   data, err := os.ReadFile(filepath.Join("../testdata", mediaFilename))
+   if err != nil {
+      t.Fatal(err)
+   }
+   media, err := DecodeMediaBytes(data)
+   if err != nil {
+      t.Fatal(err)
+   }
+   expected := []string{
+      "urn:uuid:edef8ba9-79d6-4ace-a3c8-27dcd51d21ed",
+      "com.microsoft.playready",
+      "PRMNAGRA",
+   }
+   for _, segment := range media.ResolvedSegments() {
+      if len(segment.Keys) != len(expected) {
+         t.Fatalf("Expected %d keys, got %d", len(expected), len(segment.Keys))
+      }
+      for i, keyItem := range segment.Keys {
+         if keyItem.KeyFormat != expected[i] {
+            t.Errorf("Key %d: expected %s, got %s", i, expected[i], keyItem.KeyFormat)
+         }
+      }
+      if segment.IV != "" {
+         t.Errorf("Expected no implied IV for SAMPLE-AES-CTR, got %s", segment.IV)
+      }
+   }
+   if plan := media.FetchPlan(); len(plan[1].Keys) != len(expected) {
+      t.Errorf("Expected the fetch plan to carry %d keys, got %d", len(expected), len(plan[1].Keys))
+   }
+   if points := media.KeyRotationPoints(); points != nil {
+      t.Errorf("Expected no rotation, got %v", points)
+   }
+
+   rotated, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=SAMPLE-AES,KEYFORMAT="com.apple.streamingkeydelivery",URI="skd://1"
+#EXT-X-KEY:METHOD=SAMPLE-AES,KEYFORMAT="com.widevine",URI="data:text/plain;base64,AA=="
+#EXTINF:4,
+a.ts
+#EXT-X-KEY:METHOD=SAMPLE-AES,KEYFORMAT="com.apple.streamingkeydelivery",URI="skd://2"
+#EXTINF:4,
+b.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   keys := rotated.Segments[1].Keys
+   if len(keys) != 2 || keys[0].URI.String() != "skd://2" || keys[1].KeyFormat != "com.widevine" {
+      t.Errorf("Expected the FairPlay key replaced and Widevine kept, got %v", keys)
+   }
+   if len(rotated.Segments[0].Keys) != 2 || rotated.Segments[0].Keys[0].URI.String() != "skd://1" {
+      t.Errorf("Expected the first segment's keys unchanged, got %v", rotated.Segments[0].Keys)
+   }
+}
+
+func TestAppendFrom(t *testing.T) {
+   const head = "#EXTM3U\n#EXT-X-PLAYLIST-TYPE:EVENT\n#EXT-X-TARGETDURATION:4\n"
+   previous, err := DecodeMedia(head + "#EXTINF:4,\na.ts\n#EXTINF:4,\nb.ts")
+   if err != nil {
+      t.Fatal(err)
+   }
+   current, err := DecodeMedia(head + "#EXTINF:4,\na.ts\n#EXTINF:4,\nb.ts\n#EXTINF:4,\nc.ts\n#EXT-X-ENDLIST")
+   if err != nil {
+      t.Fatal(err)
+   }
+   combined, err := current.AppendFrom(previous)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(combined.Segments) != 3 || !combined.EndList {
+      t.Errorf("Expected 3 segments and ENDLIST, got %d, %v", len(combined.Segments), combined.EndList)
+   }
+   rewritten, err := DecodeMedia(head + "#EXTINF:4,\na.ts\n#EXTINF:4,\nx.ts\n#EXTINF:4,\nc.ts")
+   if err != nil {
+      t.Fatal(err)
+   }
+   if _, err := rewritten.AppendFrom(previous); err == nil {
+      t.Error("Expected an error for a changed segment")
+   }
+   if _, err := previous.AppendFrom(current); err == nil {
+      t.Error("Expected an error for removed segments")
+   }
+}
+
+func TestIFrames(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=86000,CODECS="avc1.64001f",RESOLUTION=640x360,URI="iframe.m3u8"`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(master.IFrameStreams) != 1 || master.IFrameStreams[0].URI.String() != "iframe.m3u8" {
+      t.Fatalf("Expected one I-frame stream, got %+v", master.IFrameStreams)
+   }
+   media, err := (&DecodeOptions{Strict: true}).DecodeMedia(`#EXTM3U
+#EXT-X-VERSION:4
+#EXT-X-TARGETDURATION:4
+#EXT-X-I-FRAMES-ONLY
+#EXTINF:2.002,
+#EXT-X-BYTERANGE:9400@376
+main0.ts
+#EXTINF:2.002,
+#EXT-X-BYTERANGE:7144@121576
+main0.ts
+#EXTINF:2.002,
+#EXT-X-BYTERANGE:10340@376
+main1.ts
+#EXT-X-ENDLIST`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !media.IFramesOnly {
+      t.Error("Expected IFramesOnly")
+   }
+   expected := []string{"bytes=376-9775", "bytes=121576-128719", "bytes=376-10715"}
+   for i, segment := range media.Segments {
+      if header := segment.ByteRange.RangeHeader(); header != expected[i] {
+         t.Errorf("frame %d: expected %s, got %s", i, expected[i], header)
+      }
+   }
+   if uri := media.Segments[2].URI.String(); uri != "main1.ts" {
+      t.Errorf("Expected main1.ts, got %s", uri)
+   }
+}
+
+func TestMuxedAudio(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",URI="en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,CODECS="avc1.4d401e,mp4a.40.2",RESOLUTION=640x360
+muxed.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=3000000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=1280x720,AUDIO="aud"
+demuxed.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,CODECS="avc1.64001f",RESOLUTION=1280x720
+silent.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   muxed := make(map[string]bool)
+   for _, stream := range master.StreamInfs {
+      muxed[stream.URI.String()] = stream.IsMuxedAudio()
+   }
+   if !muxed["muxed.m3u8"] || muxed["demuxed.m3u8"] || muxed["silent.m3u8"] {
+      t.Errorf("Unexpected classification %v", muxed)
+   }
+   if !master.HasMuxedAudio() {
+      t.Error("Expected HasMuxedAudio")
+   }
+   demuxed := master.FilterStreams(func(s *StreamInf) bool { return !s.IsMuxedAudio() })
+   if demuxed.HasMuxedAudio() {
+      t.Error("Expected no muxed audio after filtering")
+   }
+}
+
+func TestBuildMaster(t *testing.T) {
+   low, _ := url.Parse("low/index.m3u8")
+   high, _ := url.Parse("high/index.m3u8")
+   master, err := BuildMaster([]MasterEntry{
+      {URI: high, Bandwidth: 3000000, Resolution: "1280x720", Codecs: "avc1.64001f,mp4a.40.2"},
+      {URI: low, Bandwidth: 800000, Resolution: "640x360", Codecs: "avc1.4d401e,mp4a.40.2"},
+   })
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(master.StreamInfs) != 2 || master.StreamInfs[0].Height() != 720 {
+      t.Fatalf("Expected entries in order, got %v", master.StreamInfs)
+   }
+   // IDs follow URI order, not entry order
+   if master.StreamInfs[1].ID != 1 {
+      t.Errorf("Expected low/index.m3u8 to get ID 1, got %d", master.StreamInfs[1].ID)
+   }
+   if _, err := BuildMaster([]MasterEntry{{URI: low}}); err == nil {
+      t.Error("Expected an error for a missing bandwidth")
+   }
+}
+
+func TestIsLowLatency(t *testing.T) {
+   media, err := DecodeMedia("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-PART-INF:PART-TARGET=1.004\n#EXTINF:4,\na.mp4")
+   if err != nil {
+      t.Fatal(err)
+   }
+   if !media.IsLowLatency() {
+      t.Error("Expected a low-latency playlist")
+   }
+   media, err = DecodeMedia("#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\na.mp4")
+   if err != nil {
+      t.Fatal(err)
+   }
+   if media.IsLowLatency() {
+      t.Error("Expected a standard playlist")
+   }
+   // A bad PART-INF only fails a strict decode
+   const bad = "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXT-X-PART-INF:FOO=1\n#EXTINF:4,\na.mp4"
+   media, err = DecodeMedia(bad)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if media.PartTarget != 0 || len(media.Segments) != 1 {
+      t.Errorf("Expected PART-TARGET 0 and 1 segment, got %g and %d", media.PartTarget, len(media.Segments))
+   }
+   strict := DecodeOptions{Strict: true}
+   if _, err := strict.DecodeMedia(bad); err == nil {
+      t.Error("Expected an error for a bad PART-INF in strict mode")
+   }
+}
+
+func TestKeyRotationPoints(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=AES-128,URI="k1",IV=0x01
+#EXTINF:4,
+a.ts
+#EXT-X-KEY:METHOD=AES-128,URI="k1",IV=0x02
+#EXTINF:4,
+b.ts
+#EXT-X-KEY:METHOD=AES-128,URI="k2"
+#EXTINF:4,
+c.ts
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4,
+d.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   points := media.KeyRotationPoints()
+   if len(points) != 2 || points[0] != 2 || points[1] != 3 {
+      t.Fatalf("Expected rotations at 2 and 3, got %v", points)
+   }
+   if uri := media.Segments[points[0]].Key.URI.String(); uri != "k2" {
+      t.Errorf("Expected k2 at the first rotation, got %s", uri)
+   }
+   single, err := DecodeMedia("#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\"\n#EXTINF:4,\na.ts\n#EXTINF:4,\nb.ts")
+   if err != nil {
+      t.Fatal(err)
+   }
+   if points := single.KeyRotationPoints(); len(points) != 0 {
+      t.Errorf("Expected no rotations, got %v", points)
+   }
+}
+
+func TestLargeBandwidth(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=3000000000,AVERAGE-BANDWIDTH=2500000000,RESOLUTION=7680x4320
+8k.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   stream := master.StreamInfs[0]
+   if stream.Bandwidth != 3000000000 || stream.EffectiveBandwidth() != 2500000000 {
+      t.Errorf("Expected 3000000000 and 2500000000, got %d and %d", stream.Bandwidth, stream.AverageBandwidth)
+   }
+}
+
+func TestDisplayName(t *testing.T) {
+   tests := []struct {
+      media    Media
+      expected string
+   }{
+      {Media{Name: "Director's commentary", Language: "en"}, "Director's commentary"},
+      {Media{Language: "fre"}, "French"},
+      {Media{Language: "pt-BR"}, "Portuguese"},
+      {Media{Language: "qaa"}, "qaa"},
+      {Media{}, "Unknown"},
+   }
+   for _, test := range tests {
+      if name := test.media.DisplayName(); name != test.expected {
+         t.Errorf("Expected %q, got %q", test.expected, name)
+      }
+   }
+}
+
+func TestAllAbsolute(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-KEY:METHOD=AES-128,URI="data:text/plain;base64,AAAA"
+#EXT-X-MAP:URI="init.mp4"
+#EXTINF:4,
+a.mp4`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   ok, relative := media.AllAbsolute()
+   if ok || len(relative) != 2 {
+      t.Errorf("Expected the map and segment to be relative, got %v", relative)
+   }
+   base, _ := url.Parse("https://example.com/media.m3u8")
+   media.ResolveURIs(base)
+   if ok, relative := media.AllAbsolute(); !ok {
+      t.Errorf("Expected all absolute after ResolveURIs, got %v", relative)
+   }
+}
+
+func TestDateRangeEndOnNext(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-DATERANGE:ID="a",CLASS="ad",START-DATE="2024-01-01T00:00:00Z",END-ON-NEXT=YES
+#EXT-X-DATERANGE:ID="x",CLASS="other",START-DATE="2024-01-01T00:00:10Z",DURATION=5
+#EXT-X-DATERANGE:ID="b",CLASS="ad",START-DATE="2024-01-01T00:00:30Z",END-ON-NEXT=YES
+#EXTINF:4,
+a.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+   if end := media.DateRanges[0].EffectiveEnd(); !end.Equal(start.Add(30 * time.Second)) {
+      t.Errorf("Expected a to end when b starts, got %v", end)
+   }
+   if end := media.DateRanges[1].EffectiveEnd(); !end.Equal(start.Add(15 * time.Second)) {
+      t.Errorf("Expected x to end after its duration, got %v", end)
+   }
+   if end := media.DateRanges[2].EffectiveEnd(); !end.IsZero() {
+      t.Errorf("Expected b to stay open, got %v", end)
+   }
+}
+
+func TestDateRangeZeroDuration(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-DATERANGE:ID="instant",START-DATE="2024-01-01T00:00:00Z",DURATION=0
+#EXT-X-DATERANGE:ID="open",START-DATE="2024-01-01T00:00:00Z"
+#EXTINF:4,
+a.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+   if end := media.DateRanges[0].EffectiveEnd(); !end.Equal(start) {
+      t.Errorf("Expected DURATION=0 to end at its start, got %v", end)
+   }
+   if end := media.DateRanges[1].EffectiveEnd(); !end.IsZero() {
+      t.Errorf("Expected a range without DURATION to stay open, got %v", end)
+   }
+}
+
+func TestTimeline(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4,
+a.ts
+#EXT-X-DISCONTINUITY
+#EXT-X-KEY:METHOD=AES-128,URI="k"
+#EXTINF:2.5,
+b.ts
+#EXT-X-GAP
+#EXTINF:4,
+c.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   timeline := media.Timeline()
+   expected := []TimelineEntry{
+      {Start: 0, End: 4},
+      {Start: 4, End: 6.5, Discontinuity: true, KeyChange: true},
+      {Start: 6.5, End: 10.5, Gap: true},
+   }
+   for i, entry := range timeline {
+      entry.URI = nil
+      if entry != expected[i] {
+         t.Errorf("entry %d: expected %+v, got %+v", i, expected[i], entry)
+      }
+   }
+}
+
+func TestURIParser(t *testing.T) {
+   const content = "#EXTM3U\n#EXTINF:4,\nseg%zz.ts"
+   media, err := DecodeMedia(content)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if media.Segments[0].URI != nil {
+      t.Errorf("Expected a nil URI, got %s", media.Segments[0].URI)
+   }
+   if _, err := (&DecodeOptions{Strict: true}).DecodeMedia(content); err == nil {
+      t.Error("Expected strict mode to reject the URI")
+   }
+   opts := DecodeOptions{
+      URIParser: func(value string) (*url.URL, error) {
+         return url.Parse(strings.ReplaceAll(value, "%zz", "%25zz"))
+      },
+   }
+   media, err = opts.DecodeMedia(content)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if uri := media.Segments[0].URI; uri == nil || uri.Path != "seg%zz.ts" {
+      t.Errorf("Expected the custom parser's URI, got %v", uri)
+   }
+}
+
+func TestSelectStreamForDisplay(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,RESOLUTION=1280x720,FRAME-RATE=29.970
+720p30.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=3000000,RESOLUTION=1280x720,FRAME-RATE=25.000
+720p25.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=6000000,RESOLUTION=1920x1080,FRAME-RATE=29.970
+1080p30.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   tests := []struct {
+      maxBandwidth, maxHeight int
+      displayFPS              float64
+      expected                string
+   }{
+      {4000000, 1080, 59.94, "720p30.m3u8"},
+      {4000000, 1080, 50, "720p25.m3u8"},
+      {9000000, 1080, 59.94, "1080p30.m3u8"},
+      {9000000, 720, 24, "720p25.m3u8"},
+      {1000, 1080, 60, "720p30.m3u8"},
+   }
+   for _, test := range tests {
+      stream := master.SelectStreamForDisplay(test.maxBandwidth, test.maxHeight, test.displayFPS)
+      if stream.URI.String() != test.expected {
+         t.Errorf("%+v: got %s", test, stream.URI)
+      }
+   }
+
+   // A stream without FRAME-RATE is unknown, not a mismatch
+   mixed, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=8000000,RESOLUTION=1920x1080
+1080p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=300000,RESOLUTION=426x240,FRAME-RATE=30
+240p30.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if stream := mixed.SelectStreamForDisplay(10000000, 1080, 60); stream.URI.String() != "1080p.m3u8" {
+      t.Errorf("Expected 1080p.m3u8, got %s", stream.URI)
+   }
+}
+
+func TestDecodeDataURI(t *testing.T) {
+   playlist, err := DecodeDataURI("data:application/vnd.apple.mpegurl;base64,I0VYVE0zVQojRVhUSU5GOjQsCmEudHMK")
+   if err != nil {
+      t.Fatal(err)
+   }
+   media, ok := playlist.(*MediaPlaylist)
+   if !ok || len(media.Segments) != 1 {
+      t.Fatalf("Expected a media playlist with one segment, got %#v", playlist)
+   }
+   if _, err := DecodeDataURI("data:image/png;base64,I0VYVE0zVQ=="); err == nil {
+      t.Error("Expected an error for an image")
+   }
+   if _, err := DecodeDataURI("data:text/plain,#EXTM3U"); err == nil {
+      t.Error("Expected an error without base64")
+   }
+}
+
+func TestEstimateRenditionBandwidth(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",URI="en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="unused",NAME="English",URI="en2.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="ec3",NAME="English",URI="ec3.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=2128000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=1280x720,AUDIO="aac"
+demuxed.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2384000,CODECS="avc1.64001f,ec-3",RESOLUTION=1280x720,AUDIO="ec3"
+ec3.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,CODECS="avc1.64001f",RESOLUTION=1280x720
+video.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2100000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=1280x720
+muxed.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,CODECS="avc1.640028",RESOLUTION=1920x1080
+other.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if estimate := master.EstimateRenditionBandwidth(master.Medias[0]); estimate != 128000 {
+      t.Errorf("Expected 128000, got %d", estimate)
+   }
+   if estimate := master.EstimateRenditionBandwidth(master.Medias[1]); estimate != 0 {
+      t.Errorf("Expected 0 for an unreferenced group, got %d", estimate)
+   }
+   // Not paired against the aac rung, which would give just the codec delta
+   if estimate := master.EstimateRenditionBandwidth(master.Medias[2]); estimate != 384000 {
+      t.Errorf("Expected 384000, got %d", estimate)
+   }
+}
+
+func TestAutoSelectRendition(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="Commentary",LANGUAGE="en"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="French",LANGUAGE="fr",AUTOSELECT=YES
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="English",LANGUAGE="en",AUTOSELECT=YES,DEFAULT=YES
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="b",NAME="Commentary",LANGUAGE="en"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="b",NAME="German",LANGUAGE="de",AUTOSELECT=YES
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="c",NAME="Only",LANGUAGE="en"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO="a"
+low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   tests := []struct {
+      group, lang, expected string
+   }{
+      {"a", "fra", "French"}, // language match among AUTOSELECT
+      {"a", "ja", "English"}, // DEFAULT
+      {"b", "en", "German"},  // first AUTOSELECT, commentary is not one
+      {"c", "fr", "Only"},    // first
+   }
+   for _, test := range tests {
+      media := master.AutoSelectRendition(test.group, test.lang)
+      if media == nil || media.Name != test.expected {
+         t.Errorf("%s/%s: expected %s, got %v", test.group, test.lang, test.expected, media)
+      }
+   }
+   if media := master.AutoSelectRendition("missing", "en"); media != nil {
+      t.Errorf("Expected nil for an unknown group, got %v", media)
+   }
+}
+
+func TestSegmentBitrate(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4,
+a.ts
+#EXT-X-BITRATE:1500
+#EXTINF:4,
+b.ts
+#EXT-X-BYTERANGE:1000000@0
+#EXTINF:4,
+c.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   for i, expected := range []int{0, 1500000, 2000000, 0} {
+      if bitrate := media.SegmentBitrate(i); bitrate != expected {
+         t.Errorf("segment %d: expected %d, got %d", i, expected, bitrate)
+      }
+   }
+   // A known size wins over the byte range, but not over EXT-X-BITRATE
+   for i, expected := range []int{1000000, 1500000, 1000000, 0} {
+      if bitrate := media.SegmentBitrateForSize(i, 500000); bitrate != expected {
+         t.Errorf("segment %d with a size: expected %d, got %d", i, expected, bitrate)
+      }
+   }
+}
+
+func TestClosedCaptionsDefault(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="English",LANGUAGE="en",INSTREAM-ID="CC1",AUTOSELECT=YES,DEFAULT=YES
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="Spanish",LANGUAGE="es",INSTREAM-ID="CC3",AUTOSELECT=YES
+#EXT-X-STREAM-INF:BANDWIDTH=1000,CLOSED-CAPTIONS="cc"
+low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   media := master.DefaultRendition("cc")
+   if media == nil || media.InstreamID != "CC1" || !media.AutoSelect || media.URI != nil {
+      t.Fatalf("Expected the URI-less CC1 default, got %v", media)
+   }
+   if media := master.AutoSelectRendition("cc", "es"); media == nil || media.InstreamID != "CC3" {
+      t.Errorf("Expected CC3 for Spanish, got %v", media)
+   }
+   if media := master.AutoSelectRendition("cc", ""); media == nil || media.InstreamID != "CC1" {
+      t.Errorf("Expected the default CC1, got %v", media)
+   }
+   if captions := master.ClosedCaptionsFor(master.StreamInfs[0]); len(captions) != 2 {
+      t.Errorf("Expected 2 caption renditions, got %d", len(captions))
+   }
+   if err := master.Validate(); err != nil {
+      t.Errorf("Expected a valid caption group, got %v", err)
+   }
+}
+
+func TestAudioForStream(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",LANGUAGE="en",AUTOSELECT=YES,DEFAULT=YES,URI="en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="Deutsch",LANGUAGE="de",AUTOSELECT=YES,URI="de.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO="aac"
+low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=900,CODECS="mp4a.40.2"
+muxed.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if media := master.AudioForStream(master.StreamInfs[0], "de"); media == nil || media.Name != "Deutsch" {
+      t.Errorf("Expected Deutsch, got %v", media)
+   }
+   if media := master.AudioForStream(master.StreamInfs[1], "de"); media != nil {
+      t.Errorf("Expected nil without an AUDIO group, got %v", media)
+   }
+}
+
+func TestRebase(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin?token=k1"
+#EXT-X-MAP:URI="init.mp4?token=i1"
+#EXTINF:4,
+video/seg0.mp4?token=abc%2Fdef&exp=1700000000`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   origin, _ := url.Parse("https://origin.example.com/live/channel1/")
+   media.ResolveURIs(origin)
+   cache, _ := url.Parse("http://cache.local/c1/")
+   if err := media.Rebase(origin, cache); err != nil {
+      t.Fatal(err)
+   }
+   expected := "http://cache.local/c1/video/seg0.mp4?token=abc%2Fdef&exp=1700000000"
+   if uri := media.Segments[0].URI.String(); uri != expected {
+      t.Errorf("Expected %s, got %s", expected, uri)
+   }
+   if uri := media.Keys[0].URI.String(); uri != "http://cache.local/c1/key.bin?token=k1" {
+      t.Errorf("Unexpected key URI %s", uri)
+   }
+   if uri := media.Segments[0].Map.URI.String(); uri != "http://cache.local/c1/init.mp4?token=i1" {
+      t.Errorf("Unexpected map URI %s", uri)
+   }
+   other, _ := url.Parse("https://origin.example.com/vod/")
+   if err := media.Rebase(other, cache); err == nil {
+      t.Error("Expected an error for URIs outside the old base")
+   }
+   if uri := media.Segments[0].URI.String(); uri != expected {
+      t.Errorf("Expected a failed Rebase to change nothing, got %s", uri)
+   }
+
+   // The old base must end at a path segment
+   versioned, err := DecodeMedia("#EXTM3U\n#EXTINF:4,\nhttps://o/v10/seg.ts?tok=1")
+   if err != nil {
+      t.Fatal(err)
+   }
+   v1, _ := url.Parse("https://o/v1")
+   proxy, _ := url.Parse("https://p/cache")
+   if err := versioned.Rebase(v1, proxy); err == nil {
+      t.Errorf("Expected /v10 not to be under /v1, got %s", versioned.Segments[0].URI)
+   }
+   v10, _ := url.Parse("https://o/v10")
+   if err := versioned.Rebase(v10, proxy); err != nil {
+      t.Fatal(err)
+   }
+   if uri := versioned.Segments[0].URI.String(); uri != "https://p/cache/seg.ts?tok=1" {
+      t.Errorf("Unexpected rebased URI %s", uri)
+   }
+
+   // The boundary gets exactly one slash
+   tests := []struct {
+      oldBase, newBase, expected string
+   }{
+      {"https://o.example", "https://c.example/cache/", "https://c.example/cache/v1/a.ts?tok=1"},
+      {"https://o.example", "https://c.example", "https://c.example/v1/a.ts?tok=1"},
+      {"https://o.example/v1", "https://c.example/cache/", "https://c.example/cache/a.ts?tok=1"},
+      {"https://o.example/v1/", "https://c.example/cache", "https://c.example/cache/a.ts?tok=1"},
+   }
+   for _, test := range tests {
+      media, err := DecodeMedia("#EXTM3U\n#EXTINF:4,\nhttps://o.example/v1/a.ts?tok=1")
+      if err != nil {
+         t.Fatal(err)
+      }
+      oldBase, _ := url.Parse(test.oldBase)
+      newBase, _ := url.Parse(test.newBase)
+      if err := media.Rebase(oldBase, newBase); err != nil {
+         t.Fatal(err)
+      }
+      if uri := media.Segments[0].URI.String(); uri != test.expected {
+         t.Errorf("%s to %s: expected %s, got %s", test.oldBase, test.newBase, test.expected, uri)
+      }
+   }
+}
+
+func TestKeyMethodNone(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=AES-128,URI="k1"
+#EXTINF:4,
+a.ts
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4,
+b.ts
+#EXTINF:4,
+c.ts
+#EXT-X-KEY:METHOD=AES-128,URI="k2"
+#EXTINF:4,
+d.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   expected := []string{"k1", "", "", "k2"}
+   for i, segment := range media.Segments {
+      var uri string
+      if segment.Key != nil {
+         uri = segment.Key.URI.String()
+      }
+      if uri != expected[i] {
+         t.Errorf("segment %d: expected key %q, got %q", i, expected[i], uri)
+      }
+   }
+   if len(media.Keys) != 3 {
+      t.Errorf("Expected Keys to keep all 3 tags, got %d", len(media.Keys))
+   }
+}
+
+func TestKeyURIs(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-KEY:METHOD=AES-128,URI="k1",IV=0x01
+#EXTINF:4,
+a.ts
+#EXT-X-KEY:METHOD=AES-128,URI="data:text/plain;base64,AAAAAAAAAAAAAAAAAAAAAA=="
+#EXTINF:4,
+b.ts
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:4,
+c.ts
+#EXT-X-KEY:METHOD=AES-128,URI="k1",IV=0x02
+#EXTINF:4,
+d.ts
+#EXT-X-KEY:METHOD=AES-128,URI="k2"
+#EXTINF:4,
+e.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   base, _ := url.Parse("https://example.com/keys/media.m3u8")
+   media.ResolveURIs(base)
+   uris := media.KeyURIs()
+   if len(uris) != 2 || uris[0].String() != "https://example.com/keys/k1" ||
+      uris[1].String() != "https://example.com/keys/k2" {
+      t.Errorf("Expected k1 and k2, got %v", uris)
+   }
+}
+
+func TestResolveQueryAndFragmentURIs(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aud",NAME="English",URI="?track=audio"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",URI="#subs"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO="aud",SUBTITLES="subs"
+?x=1`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   base, _ := url.Parse("https://example.com/show/master.m3u8?token=abc")
+   master.ResolveURIs(base)
+   // RFC 3986 section 5.2.2: a query-only reference keeps the base path and
+   // replaces the query; a fragment-only one keeps the whole base
+   expected := map[string]string{
+      "English/AUDIO":     "https://example.com/show/master.m3u8?track=audio",
+      "English/SUBTITLES": "https://example.com/show/master.m3u8?token=abc#subs",
+   }
+   for _, media := range master.Medias {
+      key := media.Name + "/" + media.Type
+      if uri := media.URI.String(); uri != expected[key] {
+         t.Errorf("%s: expected %s, got %s", key, expected[key], uri)
+      }
+   }
+   if uri := master.StreamInfs[0].URI.String(); uri != "https://example.com/show/master.m3u8?x=1" {
+      t.Errorf("Unexpected stream URI %s", uri)
+   }
+}
+
+func TestFetchPlan(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-MAP:URI="main.mp4",BYTERANGE="720@0"
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="k1",IV=0x01
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000@720
+main.mp4
+#EXT-X-GAP
+#EXTINF:4,
+#EXT-X-BYTERANGE:1000
+main.mp4`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   plan := media.FetchPlan()
+   if len(plan) != 3 {
+      t.Fatalf("Expected 3 items, got %d", len(plan))
+   }
+   if !plan[0].Init || plan[0].Range != "bytes=0-719" || plan[0].Key != nil {
+      t.Errorf("Unexpected init item %+v", plan[0])
+   }
+   if plan[1].Range != "bytes=720-1719" || plan[1].Key == nil || plan[1].IV != "0x01" {
+      t.Errorf("Unexpected segment item %+v", plan[1])
+   }
+   if !plan[2].Gap || plan[2].Range != "bytes=1720-2719" || plan[2].SequenceNumber != 1 {
+      t.Errorf("Unexpected gap item %+v", plan[2])
+   }
+}
+
+func TestMediaHeader(t *testing.T) {
+   const head = `#EXTM3U
+#EXT-X-VERSION:6
+#EXT-X-TARGETDURATION:4
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-KEY:METHOD=SAMPLE-AES,URI="skd://k1"
+#EXT-X-MAP:URI="init.mp4"
+`
+   first, err := DecodeMedia(head + "#EXT-X-MEDIA-SEQUENCE:10\n#EXTINF:4,\na.mp4\n#EXT-X-KEY:METHOD=SAMPLE-AES,URI=\"skd://k2\"\n#EXTINF:4,\nb.mp4")
+   if err != nil {
+      t.Fatal(err)
+   }
+   second, err := DecodeMedia(head + "#EXT-X-MEDIA-SEQUENCE:11\n#EXTINF:4,\nb.mp4")
+   if err != nil {
+      t.Fatal(err)
+   }
+   a, b := first.Header(), second.Header()
+   if len(a.Keys) != 1 || a.Map == nil || !a.IndependentSegments {
+      t.Fatalf("Unexpected header %+v", a)
+   }
+   if a.Equal(b) {
+      t.Error("Expected the media sequence to differ")
+   }
+   a.MediaSequence, b.MediaSequence = 0, 0
+   if !a.Equal(b) {
+      t.Error("Expected the headers to match apart from the media sequence")
+   }
+}
+
+func TestDetectType(t *testing.T) {
+   tests := []struct {
+      content string
+      kind    PlaylistKind
+      version int
+   }{
+      {"#EXTM3U\n#EXT-X-VERSION:4\n#EXT-X-STREAM-INF:BANDWIDTH=1\nlow.m3u8", KindMaster, 4},
+      {"#EXTM3U\n#EXT-X-VERSION:3\n#EXTINF:4,\na.ts", KindMedia, 3},
+      {"#EXTM3U\n#EXT-X-TARGETDURATION:4", KindMedia, 1},
+   }
+   for _, test := range tests {
+      kind, version, err := DetectType(strings.NewReader(test.content))
+      if err != nil {
+         t.Fatal(err)
+      }
+      if kind != test.kind || version != test.version {
+         t.Errorf("%q: expected %v %d, got %v %d", test.content, test.kind, test.version, kind, version)
+      }
+   }
+}
+
+func TestSortMediasByLanguage(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="s",NAME="fr",LANGUAGE="fr",URI="fr.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="b",NAME="de",LANGUAGE="de",URI="de.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="en",LANGUAGE="en-US",URI="en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="ja",LANGUAGE="jpn",URI="ja.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="es",LANGUAGE="es",URI="es.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,AUDIO="a"
+low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   master.SortMediasByLanguage("ja", "eng")
+   var names []string
+   for _, media := range master.Medias {
+      names = append(names, media.Name)
+   }
+   if order := strings.Join(names, ","); order != "ja,en,de,es,fr" {
+      t.Errorf("Expected ja,en,de,es,fr, got %s", order)
+   }
+}
+
+func TestSelectStreamBySeed(t *testing.T) {
+   a, err := DecodeMaster("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=1\na.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2\nb.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=3\nc.m3u8")
+   if err != nil {
+      t.Fatal(err)
+   }
+   b, err := DecodeMaster("#EXTM3U\n#EXT-X-STREAM-INF:BANDWIDTH=3\nc.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=1\na.m3u8\n#EXT-X-STREAM-INF:BANDWIDTH=2\nb.m3u8")
+   if err != nil {
+      t.Fatal(err)
+   }
+   picked := make(map[string]bool)
+   for seed := range uint64(64) {
+      first := a.SelectStreamBySeed(seed).URI.String()
+      if second := b.SelectStreamBySeed(seed).URI.String(); first != second {
+         t.Errorf("seed %d: %s and %s differ", seed, first, second)
+      }
+      picked[first] = true
+   }
+   if len(picked) != 3 {
+      t.Errorf("Expected 64 seeds to cover all 3 streams, got %v", picked)
+   }
+}
+
+func TestTargetDurationEstimated(t *testing.T) {
+   const content = "#EXTM3U\n#EXTINF:5.005,\na.ts\n#EXTINF:6.006,\nb.ts"
+   media, err := DecodeMedia(content)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if media.TargetDuration != 7 || !media.TargetDurationEstimated {
+      t.Errorf("Expected an estimated 7, got %d, %v", media.TargetDuration, media.TargetDurationEstimated)
+   }
+   if _, err := (&DecodeOptions{Strict: true}).DecodeMedia(content); err == nil {
+      t.Error("Expected strict mode to require EXT-X-TARGETDURATION")
+   }
+   media, err = DecodeMedia("#EXTM3U\n#EXT-X-TARGETDURATION:10\n#EXTINF:6.006,\nb.ts")
+   if err != nil {
+      t.Fatal(err)
+   }
+   if media.TargetDuration != 10 || media.TargetDurationEstimated {
+      t.Errorf("Expected the declared 10, got %d, %v", media.TargetDuration, media.TargetDurationEstimated)
+   }
+}
+
+func TestParseStats(t *testing.T) {
+   const content = `#EXTM3U
+#EXT-X-TARGETDURATION:4
+# a comment
+#EXT-X-VENDOR:1
+#EXTINF:4,
+a.ts
+
+#EXTINF:4,
+b.ts
+#EXT-X-ENDLIST
+stray.ts`
+   var stats ParseStats
+   opts := DecodeOptions{Stats: &stats}
+   if _, err := opts.DecodeMedia(content); err != nil {
+      t.Fatal(err)
+   }
+   expected := ParseStats{
+      BytesRead:    len(content),
+      LineCount:    10,
+      SegmentCount: 2,
+      SkippedLines: 2,
+      UnknownTags:  1,
+   }
+   if stats != expected {
+      t.Errorf("Expected %+v, got %+v", expected, stats)
+   }
+}
+
+func TestMergePathways(t *testing.T) {
+   cdn1, err := DecodeMaster(`#EXTM3U
+#EXT-X-START:TIME-OFFSET=10
+#EXT-X-SESSION-DATA:DATA-ID="com.example.data",URI="d.json"
+#EXT-X-SESSION-KEY:METHOD=SAMPLE-AES,URI="skd://key"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a1",NAME="English",LANGUAGE="en",STABLE-RENDITION-ID="en",URI="https://cdn1/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,AUDIO="a1",STABLE-VARIANT-ID="low",PATHWAY-ID="CDN1"
+https://cdn1/low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=3000000,AUDIO="a1",STABLE-VARIANT-ID="high",PATHWAY-ID="CDN1"
+https://cdn1/high.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   cdn2, err := DecodeMaster(`#EXTM3U
+#EXT-X-VERSION:9
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a2",NAME="English",LANGUAGE="en",STABLE-RENDITION-ID="en",URI="https://cdn2/en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,AUDIO="a2",STABLE-VARIANT-ID="low",PATHWAY-ID="CDN2"
+https://cdn2/low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if cdn1.StreamInfs[0].StableVariantID != "low" || cdn1.StreamInfs[0].PathwayID != "CDN1" {
+      t.Errorf("Stable ID not parsed: %+v", cdn1.StreamInfs[0])
+   }
+   merged, err := MergePathways(cdn1, cdn2, cdn1)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(merged.StreamInfs) != 3 || len(merged.Medias) != 2 {
+      t.Fatalf("Expected 3 streams and 2 medias, got %d and %d", len(merged.StreamInfs), len(merged.Medias))
+   }
+   if merged.Version != 9 {
+      t.Errorf("Expected version 9, got %d", merged.Version)
+   }
+   if merged.StreamInfs[0] == cdn1.StreamInfs[0] {
+      t.Error("Expected merged streams to be copies")
+   }
+   base, err := url.Parse("https://cdn/x/")
+   if err != nil {
+      t.Fatal(err)
+   }
+   merged.ResolveURIs(base)
+   if uri := cdn1.SessionData[0].URI.String(); uri != "d.json" {
+      t.Errorf("Expected the input session data unchanged, got %s", uri)
+   }
+   merged.Start.TimeOffset = 0
+   merged.SessionKeys[0].Method = "NONE"
+   if cdn1.Start.TimeOffset != 10 || cdn1.SessionKeys[0].Method != "SAMPLE-AES" {
+      t.Error("Expected the input START and session key unchanged")
+   }
+
+   conflict, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,STABLE-VARIANT-ID="low",PATHWAY-ID="CDN3"
+https://cdn3/low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if _, err := MergePathways(cdn1, conflict); err == nil {
+      t.Error("Expected an error for a conflicting STABLE-VARIANT-ID")
+   }
+}
+
+func TestVideoRenditions(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="angles",NAME="Main",DEFAULT=YES
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="angles",NAME="Goal",DEFAULT=NO,URI="goal.m3u8"
+#EXT-X-MEDIA:TYPE=VIDEO,GROUP-ID="other",NAME="Other",URI="other.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,VIDEO="angles"
+main.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1000000
+plain.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   angles := master.VideoRenditions(master.StreamInfs[0])
+   if len(angles) != 2 || angles[0].Name != "Main" || angles[1].Name != "Goal" {
+      t.Errorf("Expected Main and Goal renditions, got %v", angles)
+   }
+   if renditions := master.VideoRenditions(master.StreamInfs[1]); renditions != nil {
+      t.Errorf("Expected nil without a VIDEO group, got %v", renditions)
+   }
+}
+
+func TestIsSubtitleOnly(t *testing.T) {
+   tests := []struct {
+      content  string
+      expected bool
+   }{
+      {`#EXTM3U
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",LANGUAGE="en",URI="en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="French",LANGUAGE="fr",URI="fr.m3u8"`, true},
+      {`#EXTM3U
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",URI="en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,CODECS="wvtt",SUBTITLES="subs"
+text.m3u8`, true},
+      {`#EXTM3U
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="English",URI="en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,CODECS="avc1.64001f,mp4a.40.2",SUBTITLES="subs"
+video.m3u8`, false},
+      {`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",URI="en.m3u8"`, false},
+      {`#EXTM3U`, false},
+   }
+   for i, test := range tests {
+      master, err := DecodeMaster(test.content)
+      if err != nil {
+         t.Fatal(err)
+      }
+      if got := master.IsSubtitleOnly(); got != test.expected {
+         t.Errorf("case %d: expected %v, got %v", i, test.expected, got)
+      }
+   }
+}
+
+func TestMediaForcedOnAudio(t *testing.T) {
+   const content = `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",FORCED=YES,URI="en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",NAME="Signs",FORCED=YES,URI="signs.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,AUDIO="aac",SUBTITLES="subs"
+low.m3u8`
+   master, err := DecodeMaster(content)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if master.Medias[0].Forced {
+      t.Error("Expected FORCED to be ignored on an AUDIO rendition")
+   }
+   if !master.Medias[1].Forced {
+      t.Error("Expected FORCED to be kept on a SUBTITLES rendition")
+   }
+   opts := DecodeOptions{Strict: true}
+   if _, err := opts.DecodeMaster(content); err == nil {
+      t.Error("Expected an error for FORCED on an AUDIO rendition in strict mode")
+   }
+}
+
+func TestResolutions(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,RESOLUTION=1280x720
+a.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=8000000,RESOLUTION=3840x2160
+b.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1500000,RESOLUTION=1280x720
+c.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS="mp4a.40.2"
+audio.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   expected := []Resolution{{3840, 2160}, {1280, 720}}
+   if got := master.Resolutions(); fmt.Sprint(got) != fmt.Sprint(expected) {
+      t.Errorf("Expected %v, got %v", expected, got)
+   }
+   audio, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS="mp4a.40.2"
+audio.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if got := audio.Resolutions(); len(got) != 0 {
+      t.Errorf("Expected no resolutions, got %v", got)
+   }
+}
+
+func TestClassicMacLineEndings(t *testing.T) {
+   media, err := DecodeMedia("#EXTM3U\r#EXT-X-TARGETDURATION:4\r#EXTINF:4,\rhttps://example.com/a b.ts\r\r#EXTINF:4,\r\nb.ts\n#EXT-X-ENDLIST\r")
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(media.Segments) != 2 || !media.EndList {
+      t.Fatalf("Expected 2 segments and EXT-X-ENDLIST, got %d and %v", len(media.Segments), media.EndList)
+   }
+   if uri := media.Segments[0].URI.String(); uri != "https://example.com/a%20b.ts" {
+      t.Errorf("Unexpected first URI %q", uri)
+   }
+   if line := media.Segments[1].SourceLine; line != 6 {
+      t.Errorf("Expected the second segment on line 6, got %d", line)
+   }
+
+   const master = "#EXTM3U\r#EXT-X-STREAM-INF:BANDWIDTH=1000000\rlow.m3u8\r"
+   fromBytes, err := DecodeMasterBytes([]byte(master))
+   if err != nil {
+      t.Fatal(err)
+   }
+   if len(fromBytes.StreamInfs) != 1 || fromBytes.StreamInfs[0].URI.String() != "low.m3u8" {
+      t.Errorf("Unexpected streams %v", fromBytes.StreamInfs)
+   }
+   kind, _, err := DetectType(strings.NewReader(master))
+   if err != nil {
+      t.Fatal(err)
+   }
+   if kind != KindMaster {
+      t.Errorf("Expected KindMaster, got %v", kind)
+   }
+}
+
+func TestSelectForThroughput(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=800000
+low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1600000
+mid.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2400000
+high.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   tests := []struct {
+      kbps     int
+      factor   float64
+      expected string
+   }{
+      {2000, 0.8, "mid.m3u8"},  // 1.6 Mb/s fits exactly in 80% of 2 Mb/s
+      {2000, 1, "mid.m3u8"},    // 2.4 Mb/s does not fit in 2 Mb/s
+      {3000, 0.8, "high.m3u8"}, // 2.4 Mb/s fits exactly in 80% of 3 Mb/s
+      {500, 0.8, "low.m3u8"},   // nothing fits, so the lowest
+   }
+   for _, test := range tests {
+      stream := master.SelectForThroughput(test.kbps, test.factor)
+      if uri := stream.URI.String(); uri != test.expected {
+         t.Errorf("%d kbps at %g: expected %s, got %s", test.kbps, test.factor, test.expected, uri)
+      }
+   }
+}
+
+func TestClosedCaptionsFor(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="English",INSTREAM-ID="CC1"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="Spanish",INSTREAM-ID="CC3"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,CLOSED-CAPTIONS="cc"
+group.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2000,CLOSED-CAPTIONS=NONE
+none.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=3000
+absent.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if captions := master.ClosedCaptionsFor(master.StreamInfs[0]); len(captions) != 2 {
+      t.Errorf("Expected 2 caption renditions, got %d", len(captions))
+   }
+   for _, stream := range master.StreamInfs[1:] {
+      if captions := master.ClosedCaptionsFor(stream); captions != nil {
+         t.Errorf("%s: expected nil, got %v", stream.URI, captions)
+      }
+   }
+   if err := master.Validate(); err != nil {
+      t.Errorf("Expected a valid playlist, got %v", err)
+   }
+
+   invalid, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="English",URI="cc.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000,CLOSED-CAPTIONS="cc"
+group.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2000,CLOSED-CAPTIONS="missing"
+missing.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if captions := invalid.ClosedCaptionsFor(invalid.StreamInfs[0]); captions != nil {
+      t.Errorf("Expected the invalid rendition to be skipped, got %v", captions)
+   }
+   err = invalid.Validate()
+   for _, expected := range []string{"must not have a URI", "requires INSTREAM-ID", `group "missing"`} {
+      if err == nil || !strings.Contains(err.Error(), expected) {
+         t.Errorf("Expected an error containing %q, got %v", expected, err)
+      }
+   }
+}
+
+func TestLiveEdge(t *testing.T) {
+   const head = "#EXTM3U\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\na.ts\n#EXTINF:4,\nb.ts\n"
+   tests := []struct {
+      content  string
+      expected string
+   }{
+      {head, "b.ts"},
+      {head + "#EXTINF:4,", "b.ts"}, // URI line not published yet
+      {head + "#EXT-X-ENDLIST", ""},
+      {"#EXTM3U\n#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-TARGETDURATION:4\n#EXTINF:4,\na.ts", ""},
+      {"#EXTM3U\n#EXT-X-TARGETDURATION:4", ""},
+   }
+   for i, test := range tests {
+      media, err := DecodeMedia(test.content)
+      if err != nil {
+         t.Fatal(err)
+      }
+      segment, ok := media.LiveEdge()
+      if ok != (test.expected != "") {
+         t.Errorf("case %d: expected ok %v, got %v", i, test.expected != "", ok)
+         continue
+      }
+      if ok && segment.URI.String() != test.expected {
+         t.Errorf("case %d: expected %s, got %s", i, test.expected, segment.URI)
+      }
+   }
+}
+
+func TestTitleAttributes(t *testing.T) {
+   tests := []struct {
+      title    string
+      expected map[string]string
+   }{
+      {"", nil},
+      {"Chapter One", nil},
+      {"Episode 1: a=b", nil},
+      {"x=1;", map[string]string{"x": "1"}},
+      {"x=1; y = 2", map[string]string{"x": "1", "y": "2"}},
+      {"x=1;plain", nil},
+   }
+   for _, test := range tests {
+      segment := &Segment{Title: test.title}
+      got := segment.TitleAttributes()
+      if fmt.Sprint(got) != fmt.Sprint(test.expected) || (got == nil) != (test.expected == nil) {
+         t.Errorf("%q: expected %v, got %v", test.title, test.expected, got)
+      }
+   }
+}
+
+func TestIsMonotonic(t *testing.T) {
+   const head = "#EXTM3U\n#EXT-X-TARGETDURATION:4\n"
+   tests := []struct {
+      content  string
+      expected bool
+   }{
+      {head + "#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00Z\n#EXTINF:4,\na.ts\n#EXTINF:4,\nb.ts\n#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:08Z\n#EXTINF:4,\nc.ts", true},
+      {head + "#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:08Z\n#EXTINF:4,\na.ts\n#EXT-X-PROGRAM-DATE-TIME:2024-01-01T00:00:00Z\n#EXTINF:4,\nb.ts", false},
+      {head + "#EXTINF:4,\na.ts\n#EXTINF:-1,\nb.ts", false},
+   }
+   for i, test := range tests {
+      media, err := DecodeMedia(test.content)
+      if err != nil {
+         t.Fatal(err)
+      }
+      if got := media.IsMonotonic(); got != test.expected {
+         t.Errorf("case %d: expected %v, got %v", i, test.expected, got)
+      }
+      err = media.Validate()
+      if reported := err != nil && strings.Contains(err.Error(), "going backwards"); reported == test.expected {
+         t.Errorf("case %d: expected Validate to report it %v, got %v", i, !test.expected, err)
+      }
+   }
+}
+
+func TestMediaTypeStrict(t *testing.T) {
+   const content = `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUIDO,GROUP-ID="aac",NAME="English",URI="en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,AUDIO="aac"
+low.m3u8`
+   opts := DecodeOptions{Strict: true}
+   if _, err := opts.DecodeMaster(content); err == nil {
+      t.Error("Expected an error for TYPE=AUIDO in strict mode")
+   }
+   master, err := DecodeMaster(content)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if media := master.Medias[0]; media.Type != "AUIDO" || media.MediaType().Valid() {
+      t.Errorf("Expected the invalid TYPE to be kept as is, got %q", media.Type)
+   }
+}
+
+func TestStripEncryption(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXT-X-KEY:METHOD=AES-128,URI="key.bin"
+#EXT-X-MAP:URI="init.mp4",BYTERANGE="50@0"
+#EXTINF:4,
+#EXT-X-BYTERANGE:100@50
+a.mp4
+#EXTINF:4,
+b.mp4`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   stripped := media.StripEncryption()
+   if len(stripped.Keys) != 0 {
+      t.Errorf("Expected no keys, got %d", len(stripped.Keys))
+   }
+   for i, segment := range stripped.Segments {
+      if segment.Key != nil || segment.Keys != nil {
+         t.Errorf("segment %d: expected no keys", i)
+      }
+   }
+   if len(media.Keys) != 1 {
+      t.Errorf("Expected the original to keep its key, got %d", len(media.Keys))
+   }
+   stripped.Segments[0].ByteRange.Length = 1
+   stripped.Segments[0].Map.ByteRange.Length = 1
+   if media.Segments[0].ByteRange.Length != 100 || media.Segments[0].Map.ByteRange.Length != 50 {
+      t.Error("Expected the original byte ranges to be unchanged")
+   }
+   for i, segment := range media.Segments {
+      if segment.Key == nil || len(segment.Keys) != 1 {
+         t.Errorf("segment %d: expected the original to keep its key", i)
+      }
+   }
+}
+
+func TestAudioOnlyStreams(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=64000,CODECS="mp4a.40.2"
+audio.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=500000
+unknown.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=1280x720
+av.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   uris := func(streams []*StreamInf) string {
+      var names []string
+      for _, stream := range streams {
+         names = append(names, stream.URI.String())
+      }
+      return strings.Join(names, " ")
+   }
+   if got := uris(master.AudioOnlyStreams()); got != "audio.m3u8" {
+      t.Errorf("Expected audio.m3u8 to be audio-only, got %q", got)
+   }
+   // A stream without CODECS cannot be classified, so it counts as video
+   if got := uris(master.VideoStreams()); got != "unknown.m3u8 av.m3u8" {
+      t.Errorf("Expected unknown.m3u8 and av.m3u8 as video, got %q", got)
+   }
+}
+
+func TestLadderReport(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=2400000,RESOLUTION=1920x1080,FRAME-RATE=30,CODECS="avc1.640028,mp4a.40.2",AUDIO="aac"
+high.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=900000,AVERAGE-BANDWIDTH=800000,RESOLUTION=640x360,CODECS="avc1.64001e"
+low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   expected := "" +
+      "bandwidth  average  resolution  fps  codecs                 audio\n" +
+      "900000     800000   640x360          avc1.64001e            \n" +
+      "2400000             1920x1080   30   avc1.640028,mp4a.40.2  aac\n"
+   if report := master.LadderReport(); report != expected {
+      t.Errorf("Expected:\n%s\ngot:\n%s", expected, report)
+   }
+   if master.StreamInfs[0].URI.String() != "high.m3u8" {
+      t.Error("Expected LadderReport not to reorder StreamInfs")
+   }
+}
+
+func TestSubtitleTracks(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs-low",NAME="English",LANGUAGE="en",URI="en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs-high",NAME="English",LANGUAGE="en",URI="en.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs-high",NAME="French",LANGUAGE="fr",URI="fr.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",URI="audio.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,SUBTITLES="subs-low"
+low.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,SUBTITLES="subs-high"
+high.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   tracks := master.SubtitleTracks()
+   if len(tracks) != 2 {
+      t.Fatalf("Expected 2 tracks, got %d", len(tracks))
+   }
+   if tracks[0].URI.String() != "en.m3u8" || tracks[0].GroupID != "subs-low" {
+      t.Errorf("Expected the first en.m3u8 rendition, got %+v", tracks[0])
+   }
+   if tracks[1].URI.String() != "fr.m3u8" {
+      t.Errorf("Expected fr.m3u8, got %s", tracks[1].URI)
+   }
+}
+
+func TestVideoLayout(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=8000000,CODECS="mvc1.640028",REQ-VIDEO-LAYOUT="CH-STEREO,CH-MONO"
+stereo.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=4000000,CODECS="avc1.640028"
+mono.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if layout := master.StreamInfs[0].VideoLayout; layout != "CH-STEREO,CH-MONO" {
+      t.Errorf("Expected CH-STEREO,CH-MONO, got %q", layout)
+   }
+   if layout := master.StreamInfs[1].VideoLayout; layout != "" {
+      t.Errorf("Expected no layout, got %q", layout)
+   }
+}
+
+func TestSupplementalCodecs(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-STREAM-INF:BANDWIDTH=8000000,CODECS="hvc1.2.20000000.L153.B0,ec-3",SUPPLEMENTAL-CODECS="dvh1.08.07/db4h, dvh1.08.06/db4h"
+dv.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=4000000,CODECS="hvc1.2.4.L150.90"
+hdr10.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   stream := master.StreamInfs[0]
+   if stream.SupplementalCodecs != "dvh1.08.07/db4h, dvh1.08.06/db4h" {
+      t.Errorf("Unexpected SUPPLEMENTAL-CODECS %q", stream.SupplementalCodecs)
+   }
+   expected := []string{"dvh1.08.07/db4h", "dvh1.08.06/db4h"}
+   if got := stream.SupplementalCodecList(); fmt.Sprint(got) != fmt.Sprint(expected) {
+      t.Errorf("Expected %v, got %v", expected, got)
+   }
+   if got := master.StreamInfs[1].SupplementalCodecList(); got != nil {
+      t.Errorf("Expected nil, got %v", got)
+   }
+}
+
+func TestAssocLanguage(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="Deutsch",LANGUAGE="de",ASSOC-LANGUAGE="de-CH",URI="de.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",LANGUAGE="en",URI="en.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,AUDIO="aac"
+low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   if assoc := master.Medias[0].AssocLanguage; assoc != "de-CH" {
+      t.Errorf("Expected de-CH, got %q", assoc)
+   }
+   if assoc := master.Medias[1].AssocLanguage; assoc != "" {
+      t.Errorf("Expected no ASSOC-LANGUAGE, got %q", assoc)
+   }
+}
+
+func TestDownloadableSegments(t *testing.T) {
+   media, err := DecodeMedia(`#EXTM3U
+#EXT-X-TARGETDURATION:4
+#EXTINF:4,
+a.ts
+#EXT-X-GAP
+#EXTINF:4,
+b.ts
+#EXTINF:4,
+c.ts`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   segments := media.DownloadableSegments()
+   if len(segments) != 2 || segments[0].URI.String() != "a.ts" || segments[1].URI.String() != "c.ts" {
+      t.Errorf("Expected a.ts and c.ts, got %v", segments)
+   }
+   if segments[1].StartTime != 8 {
+      t.Errorf("Expected the gap to still count towards StartTime, got %g", segments[1].StartTime)
+   }
+   if len(media.Segments) != 3 {
+      t.Errorf("Expected Segments to be unchanged, got %d", len(media.Segments))
+   }
+}
+
+func TestSortStreamsOnly(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="z",NAME="Zulu",URI="z.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="a",NAME="Alpha",URI="a.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=2000000,AUDIO="z"
+high.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=1000000,AUDIO="a"
+low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   master.SortStreamsOnly()
+   if master.StreamInfs[0].URI.String() != "low.m3u8" || master.StreamInfs[1].URI.String() != "high.m3u8" {
+      t.Errorf("Expected streams sorted by bandwidth, got %s, %s", master.StreamInfs[0].URI, master.StreamInfs[1].URI)
+   }
+   if master.Medias[0].Name != "Zulu" || master.Medias[1].Name != "Alpha" {
+      t.Errorf("Expected Medias in the author's order, got %s, %s", master.Medias[0].Name, master.Medias[1].Name)
+   }
+}
+
+func TestFilterStreamsCopies(t *testing.T) {
+   master, err := DecodeMaster(`#EXTM3U
+#EXT-X-START:TIME-OFFSET=10
+#EXT-X-STREAM-INF:BANDWIDTH=1000000
+low.m3u8`)
+   if err != nil {
+      t.Fatal(err)
+   }
+   filtered := master.FilterStreams(func(*StreamInf) bool { return true })
+   filtered.Start.TimeOffset = 0
+   filtered.StreamInfs[0].Bandwidth = 0
+   if master.Start.TimeOffset != 10 || master.StreamInfs[0].Bandwidth != 1000000 {
+      t.Error("Expected the original to be unchanged")
+   }
+}
@@ -0,0 +1,139 @@
+package hls
+
+import "strings"
+
+// LanguageMatches reports whether the rendition's LANGUAGE has the same
+// primary language as pref, so that "en", "en-US", "EN_us" and "eng" all
+// match each other. Only the primary subtag is compared, and three-letter
+// ISO 639-2 codes are mapped to their two-letter form from a small built-in
+// table of common languages. This avoids depending on
+// golang.org/x/text/language; callers that need full BCP 47 matching can
+// use it on Language directly.
+func (r *Media) LanguageMatches(pref string) bool {
+   language := primaryLanguage(r.Language)
+   return language != "" && language == primaryLanguage(pref)
+}
+
+// DisplayName returns a label for track pickers: NAME if present, otherwise
+// the English name of the primary language of LANGUAGE, otherwise LANGUAGE
+// as written if the language is not in the built-in table, and otherwise
+// "Unknown".
+func (r *Media) DisplayName() string {
+   if r.Name != "" {
+      return r.Name
+   }
+   if name, ok := languageNames[primaryLanguage(r.Language)]; ok {
+      return name
+   }
+   if r.Language != "" {
+      return r.Language
+   }
+   return "Unknown"
+}
+
+// primaryLanguage returns the lower-cased primary subtag of tag, in its
+// two-letter form where known.
+func primaryLanguage(tag string) string {
+   primary, _, _ := strings.Cut(strings.TrimSpace(tag), "-")
+   primary, _, _ = strings.Cut(primary, "_")
+   primary = strings.ToLower(primary)
+   if short, ok := iso639Alpha3[primary]; ok {
+      return short
+   }
+   return primary
+}
+
+// iso639Alpha3 maps ISO 639-2 codes, bibliographic and terminology forms
+// alike, to ISO 639-1.
+var iso639Alpha3 = map[string]string{
+   "ara": "ar",
+   "ben": "bn",
+   "bul": "bg",
+   "cat": "ca",
+   "ces": "cs", "cze": "cs",
+   "chi": "zh", "zho": "zh",
+   "dan": "da",
+   "deu": "de", "ger": "de",
+   "ell": "el", "gre": "el",
+   "eng": "en",
+   "est": "et",
+   "fas": "fa", "per": "fa",
+   "fin": "fi",
+   "fra": "fr", "fre": "fr",
+   "heb": "he",
+   "hin": "hi",
+   "hrv": "hr",
+   "hun": "hu",
+   "ind": "id",
+   "isl": "is", "ice": "is",
+   "ita": "it",
+   "jpn": "ja",
+   "kor": "ko",
+   "lav": "lv",
+   "lit": "lt",
+   "may": "ms", "msa": "ms",
+   "nld": "nl", "dut": "nl",
+   "nor": "no",
+   "pol": "pl",
+   "por": "pt",
+   "ron": "ro", "rum": "ro",
+   "rus": "ru",
+   "slk": "sk", "slo": "sk",
+   "slv": "sl",
+   "spa": "es",
+   "srp": "sr",
+   "swe": "sv",
+   "tam": "ta",
+   "tel": "te",
+   "tha": "th",
+   "tur": "tr",
+   "ukr": "uk",
+   "vie": "vi",
+}
+
+// languageNames maps ISO 639-1 codes to English language names.
+var languageNames = map[string]string{
+   "ar": "Arabic",
+   "bg": "Bulgarian",
+   "bn": "Bengali",
+   "ca": "Catalan",
+   "cs": "Czech",
+   "da": "Danish",
+   "de": "German",
+   "el": "Greek",
+   "en": "English",
+   "es": "Spanish",
+   "et": "Estonian",
+   "fa": "Persian",
+   "fi": "Finnish",
+   "fr": "French",
+   "he": "Hebrew",
+   "hi": "Hindi",
+   "hr": "Croatian",
+   "hu": "Hungarian",
+   "id": "Indonesian",
+   "is": "Icelandic",
+   "it": "Italian",
+   "ja": "Japanese",
+   "ko": "Korean",
+   "lt": "Lithuanian",
+   "lv": "Latvian",
+   "ms": "Malay",
+   "nl": "Dutch",
+   "no": "Norwegian",
+   "pl": "Polish",
+   "pt": "Portuguese",
+   "ro": "Romanian",
+   "ru": "Russian",
+   "sk": "Slovak",
+   "sl": "Slovenian",
+   "sr": "Serbian",
+   "sv": "Swedish",
+   "ta": "Tamil",
+   "te": "Telugu",
+   "th": "Thai",
+   "tr": "Turkish",
+   "uk": "Ukrainian",
+   "vi": "Vietnamese",
+   "zh": "Chinese",
+}
@@ -1,26 +1,39 @@
 package hls
 
 import (
+   "encoding/binary"
+   "errors"
    "fmt"
+   "hash/fnv"
+   "math"
    "net/url"
    "sort"
    "strconv"
    "strings"
+   "text/tabwriter"
 )
 
 // StreamInf represents a single media playlist (URI) from a #EXT-X-STREAM-INF tag.
 // It aggregates information from all tags that point to the same URI. The primary
-// attributes are taken from the variant with the lowest bandwidth.
+// attributes are taken from the variant with the lowest EffectiveBandwidth,
+// with ties going to the lower BANDWIDTH.
 type StreamInf struct {
-   URI              *url.URL
-   ID               int
-   Bandwidth        int
-   AverageBandwidth int
-   Codecs           string
-   Resolution       string
-   FrameRate        string
-   Subtitles        string   // Refers to a Media GROUP-ID for subtitles
-   Audio            []string // A list of associated audio Media GROUP-IDs
+   URI                *url.URL
+   ID                 int // See MasterPlaylist for how IDs are assigned
+   Bandwidth          int64
+   AverageBandwidth   int64
+   Codecs             string
+   SupplementalCodecs string // SUPPLEMENTAL-CODECS, such as Dolby Vision
+   Resolution         string
+   FrameRate          string
+   VideoLayout        string   // REQ-VIDEO-LAYOUT, such as "CH-STEREO"
+   Video              string   // Refers to a Media GROUP-ID for video
+   Subtitles          string   // Refers to a Media GROUP-ID for subtitles
+   ClosedCaptions     string   // A Media GROUP-ID, "NONE", or empty if absent
+   Audio              []string // A list of associated audio Media GROUP-IDs
+   StableVariantID    string   // STABLE-VARIANT-ID, shared across pathways
+   PathwayID          string   // PATHWAY-ID, the content steering pathway
+   SourceLine         int      // Line of the first #EXT-X-STREAM-INF for the URI
 }
 
 // String returns a multi-line summary of the StreamInf.
@@ -29,12 +42,12 @@ func (s *StreamInf) String() string {
 
    if s.AverageBandwidth > 0 {
       builder.WriteString("average_bandwidth = ")
-      builder.WriteString(strconv.Itoa(s.AverageBandwidth))
+      builder.WriteString(strconv.FormatInt(s.AverageBandwidth, 10))
       builder.WriteString("\n")
    }
 
    builder.WriteString("bandwidth = ")
-   builder.WriteString(strconv.Itoa(s.Bandwidth))
+   builder.WriteString(strconv.FormatInt(s.Bandwidth, 10))
 
    if s.Resolution != "" {
       builder.WriteString("\nresolution = ")
@@ -51,17 +64,151 @@ func (s *StreamInf) String() string {
    return builder.String()
 }
 
+// lowerThan reports whether s sorts before other: lower EffectiveBandwidth,
+// then lower Bandwidth.
+func (s *StreamInf) lowerThan(other *StreamInf) bool {
+   if s.EffectiveBandwidth() != other.EffectiveBandwidth() {
+      return s.EffectiveBandwidth() < other.EffectiveBandwidth()
+   }
+   return s.Bandwidth < other.Bandwidth
+}
+
+// CodecList returns the entries of Codecs.
+func (s *StreamInf) CodecList() []string {
+   return splitCodecs(s.Codecs)
+}
+
+// SupplementalCodecList returns the entries of SupplementalCodecs. An entry
+// may carry compatibility brands after a slash, such as "dvh1.08.07/db4h".
+func (s *StreamInf) SupplementalCodecList() []string {
+   return splitCodecs(s.SupplementalCodecs)
+}
+
+// Width returns the width from Resolution, or 0 if it is missing or invalid.
+func (s *StreamInf) Width() int {
+   width, _, _ := strings.Cut(s.Resolution, "x")
+   value, _ := strconv.Atoi(width)
+   return value
+}
+
+// Height returns the height from Resolution, or 0 if it is missing or invalid.
+func (s *StreamInf) Height() int {
+   _, height, _ := strings.Cut(s.Resolution, "x")
+   value, _ := strconv.Atoi(height)
+   return value
+}
+
+// FrameRateValue returns FrameRate as a number, or 0 if it is missing or
+// invalid.
+func (s *StreamInf) FrameRateValue() float64 {
+   value, _ := strconv.ParseFloat(s.FrameRate, 64)
+   return value
+}
+
+// CodecResolutionWarnings flags avc1 and hvc1 codecs whose profile or level
+// looks too low for the stream's resolution. The check is heuristic, so the
+// results are warnings rather than errors.
+func (s *StreamInf) CodecResolutionWarnings() []string {
+   width, height := s.Width(), s.Height()
+   if width <= 0 || height <= 0 {
+      return nil
+   }
+   var warnings []string
+   for _, codec := range s.CodecList() {
+      if warning := codecWarning(codec, width, height); warning != "" {
+         warnings = append(warnings, warning)
+      }
+   }
+   return warnings
+}
+
+// HasClosedCaptions reports whether the stream references a CLOSED-CAPTIONS
+// group. ClosedCaptions keeps the three states apart: a group ID (true),
+// "NONE" (false; captions must not be rendered even if a group exists), and
+// empty when the attribute is absent (false; captions are unspecified, so a
+// player may still find them in the video).
+func (s *StreamInf) HasClosedCaptions() bool {
+   return s.ClosedCaptions != "" && s.ClosedCaptions != "NONE"
+}
+
+// videoCodec returns the sample entry type of the first video codec in
+// CODECS, or "" if there is none.
+func (s *StreamInf) videoCodec() string {
+   for _, codec := range s.CodecList() {
+      if !isAudioCodec(codec) && !isTextCodec(codec) {
+         fourcc, _, _ := strings.Cut(codec, ".")
+         return fourcc
+      }
+   }
+   return ""
+}
+
+// IsMuxedAudio reports whether the stream carries its audio in the variant
+// itself: it references no AUDIO group, yet CODECS lists an audio codec.
+// Such variants cannot switch audio tracks independently of the video.
+func (s *StreamInf) IsMuxedAudio() bool {
+   if len(s.Audio) > 0 {
+      return false
+   }
+   for _, codec := range s.CodecList() {
+      if isAudioCodec(codec) {
+         return true
+      }
+   }
+   return false
+}
+
+// IsAudioOnly reports whether the stream has no RESOLUTION and only audio
+// (or subtitle) codecs. A stream without CODECS is not audio-only, as it
+// cannot be classified.
+func (s *StreamInf) IsAudioOnly() bool {
+   if s.Resolution != "" {
+      return false
+   }
+   var audio bool
+   for _, codec := range s.CodecList() {
+      switch {
+      case isAudioCodec(codec):
+         audio = true
+      case !isTextCodec(codec):
+         return false
+      }
+   }
+   return audio
+}
+
 // SortBandwidth determines the value to use for sorting, prioritizing average bandwidth.
-func (s *StreamInf) SortBandwidth() int {
+func (s *StreamInf) SortBandwidth() int64 {
+   return s.EffectiveBandwidth()
+}
+
+// EffectiveBandwidth returns the bandwidth to use when selecting a stream:
+// AverageBandwidth if present, otherwise Bandwidth.
+func (s *StreamInf) EffectiveBandwidth() int64 {
    if s.AverageBandwidth > 0 {
       return s.AverageBandwidth
    }
    return s.Bandwidth
 }
 
+// MasterPlaylist is a parsed Master Playlist.
+//
+// StreamInf and Media IDs share one sequence, so an ID identifies a single
+// item across both slices. IDs are assigned after parsing: streams first,
+// ordered by URI, then medias, ordered by URI, TYPE, GROUP-ID, NAME and
+// LANGUAGE. The same logical playlist therefore yields the same IDs however
+// its tags are ordered.
 type MasterPlaylist struct {
-   StreamInfs []*StreamInf
-   Medias     []*Media
+   Version             int
+   IndependentSegments bool   // from #EXT-X-INDEPENDENT-SEGMENTS
+   Start               *Start // nil without #EXT-X-START
+   StreamInfs          []*StreamInf
+   // IFrameStreams are the trick-play streams from #EXT-X-I-FRAME-STREAM-INF.
+   // Their URI comes from the URI attribute, and they have no ID.
+   IFrameStreams []*StreamInf
+   Medias        []*Media
+   SessionData   []*SessionData
+   SessionKeys   []*Key // from #EXT-X-SESSION-KEY
 }
 
 // ResolveURIs converts relative URLs to absolute URLs using the base URL.
@@ -71,11 +218,22 @@ func (mp *MasterPlaylist) ResolveURIs(base *url.URL) {
          streamItem.URI = base.ResolveReference(streamItem.URI)
       }
    }
+   for _, streamItem := range mp.IFrameStreams {
+      if streamItem.URI != nil {
+         streamItem.URI = base.ResolveReference(streamItem.URI)
+      }
+   }
    for _, mediaItem := range mp.Medias {
       if mediaItem.URI != nil {
          mediaItem.URI = base.ResolveReference(mediaItem.URI)
       }
    }
+   for _, dataItem := range mp.SessionData {
+      dataItem.resolve(base)
+   }
+   for _, keyItem := range mp.SessionKeys {
+      keyItem.resolve(base)
+   }
 }
 
 // Sort sorts the StreamInfs and Medias slices in place.
@@ -83,27 +241,681 @@ func (mp *MasterPlaylist) ResolveURIs(base *url.URL) {
 // otherwise falling back to minimum bandwidth.
 // Medias are sorted by GroupID.
 func (mp *MasterPlaylist) Sort() {
+   mp.SortStreamsOnly()
+   sort.Slice(mp.Medias, func(i, j int) bool {
+      return mp.Medias[i].GroupID < mp.Medias[j].GroupID
+   })
+}
+
+// SortStreamsOnly sorts StreamInfs like Sort but leaves Medias in the order
+// the author wrote them, which track pickers often want to keep.
+func (mp *MasterPlaylist) SortStreamsOnly() {
    sort.Slice(mp.StreamInfs, func(i, j int) bool {
       return mp.StreamInfs[i].SortBandwidth() < mp.StreamInfs[j].SortBandwidth()
    })
-   sort.Slice(mp.Medias, func(i, j int) bool {
-      return mp.Medias[i].GroupID < mp.Medias[j].GroupID
+}
+
+// SortMediasByLanguage sorts Medias for a track picker: by TYPE, then
+// renditions in the preferred languages in the order given, then the rest
+// alphabetically by LANGUAGE. Languages are compared as in LanguageMatches.
+// The sort is stable, so the author's order breaks ties. Sort's GroupID
+// order stays available.
+func (mp *MasterPlaylist) SortMediasByLanguage(preferred ...string) {
+   rank := func(m *Media) int {
+      for i, language := range preferred {
+         if m.LanguageMatches(language) {
+            return i
+         }
+      }
+      return len(preferred)
+   }
+   sort.SliceStable(mp.Medias, func(i, j int) bool {
+      a, b := mp.Medias[i], mp.Medias[j]
+      if a.Type != b.Type {
+         return a.Type < b.Type
+      }
+      if rankA, rankB := rank(a), rank(b); rankA != rankB {
+         return rankA < rankB
+      }
+      return primaryLanguage(a.Language) < primaryLanguage(b.Language)
+   })
+}
+
+// LadderReport returns an aligned table of the streams sorted by
+// SortBandwidth, without changing the order of StreamInfs. BANDWIDTH and
+// AVERAGE-BANDWIDTH get a column each; the latter is blank when absent.
+func (mp *MasterPlaylist) LadderReport() string {
+   streams := append([]*StreamInf(nil), mp.StreamInfs...)
+   sort.SliceStable(streams, func(i, j int) bool {
+      return streams[i].SortBandwidth() < streams[j].SortBandwidth()
+   })
+   var builder strings.Builder
+   writer := tabwriter.NewWriter(&builder, 0, 0, 2, ' ', 0)
+   fmt.Fprintln(writer, "bandwidth\taverage\tresolution\tfps\tcodecs\taudio")
+   for _, stream := range streams {
+      var average string
+      if stream.AverageBandwidth > 0 {
+         average = strconv.FormatInt(stream.AverageBandwidth, 10)
+      }
+      fmt.Fprintf(
+         writer, "%d\t%s\t%s\t%s\t%s\t%s\n", stream.Bandwidth, average,
+         stream.Resolution, stream.FrameRate, stream.Codecs,
+         strings.Join(stream.Audio, ","),
+      )
+   }
+   writer.Flush()
+   return builder.String()
+}
+
+// DiffLadder compares the (BANDWIDTH, RESOLUTION, CODECS) of the streams in
+// mp and other, ignoring URIs and order. A stream in other but not in mp is
+// reported as "add", the reverse as "remove". A stream whose resolution and
+// codecs match on both sides but whose bandwidth differs is reported as
+// "change". The result is sorted, and empty if the ladders match.
+func (mp *MasterPlaylist) DiffLadder(other *MasterPlaylist) []string {
+   type rung struct {
+      bandwidth  int64
+      resolution string
+      codecs     string
+   }
+   count := func(streams []*StreamInf) map[rung]int {
+      rungs := make(map[rung]int)
+      for _, stream := range streams {
+         rungs[rung{stream.Bandwidth, stream.Resolution, stream.Codecs}]++
+      }
+      return rungs
+   }
+   oldRungs, newRungs := count(mp.StreamInfs), count(other.StreamInfs)
+   // expand the rungs only on one side into sorted slices, so changes are
+   // paired deterministically
+   expand := func(a, b map[rung]int) []rung {
+      var rungs []rung
+      for key, n := range a {
+         for ; n > b[key]; n-- {
+            rungs = append(rungs, key)
+         }
+      }
+      sort.Slice(rungs, func(i, j int) bool {
+         if rungs[i].resolution != rungs[j].resolution {
+            return rungs[i].resolution < rungs[j].resolution
+         }
+         if rungs[i].codecs != rungs[j].codecs {
+            return rungs[i].codecs < rungs[j].codecs
+         }
+         return rungs[i].bandwidth < rungs[j].bandwidth
+      })
+      return rungs
+   }
+   removed, added := expand(oldRungs, newRungs), expand(newRungs, oldRungs)
+   format := func(r rung) string {
+      return fmt.Sprintf("bandwidth=%d resolution=%s codecs=%s", r.bandwidth, r.resolution, r.codecs)
+   }
+   paired := make([]bool, len(added))
+   var diffs []string
+   for _, oldRung := range removed {
+      changed := false
+      for k, newRung := range added {
+         if paired[k] || newRung.resolution != oldRung.resolution || newRung.codecs != oldRung.codecs {
+            continue
+         }
+         paired[k], changed = true, true
+         diffs = append(diffs, fmt.Sprintf(
+            "change %s -> bandwidth=%d", format(oldRung), newRung.bandwidth,
+         ))
+         break
+      }
+      if !changed {
+         diffs = append(diffs, "remove "+format(oldRung))
+      }
+   }
+   for k, newRung := range added {
+      if !paired[k] {
+         diffs = append(diffs, "add "+format(newRung))
+      }
+   }
+   sort.Strings(diffs)
+   return diffs
+}
+
+// ClosedCaptionsFor returns the CLOSED-CAPTIONS renditions referenced by the
+// stream. It returns nil if the stream declares NONE or no group.
+func (mp *MasterPlaylist) ClosedCaptionsFor(s *StreamInf) []*Media {
+   if !s.HasClosedCaptions() {
+      return nil
+   }
+   var medias []*Media
+   for _, media := range mp.Medias {
+      if media.MediaType() != MediaTypeClosedCaptions || media.GroupID != s.ClosedCaptions {
+         continue
+      }
+      // Caption renditions are carried in the video and never have a URI
+      if media.URI != nil || media.InstreamID == "" {
+         continue
+      }
+      medias = append(medias, media)
+   }
+   return medias
+}
+
+// VideoRenditions returns the VIDEO renditions in the stream's VIDEO group,
+// such as the angles of a multi-angle presentation. A rendition without a
+// URI is the video of the stream itself. It returns nil if the stream has no
+// VIDEO group.
+func (mp *MasterPlaylist) VideoRenditions(s *StreamInf) []*Media {
+   if s.Video == "" {
+      return nil
+   }
+   var medias []*Media
+   for _, media := range mp.Medias {
+      if media.MediaType() == MediaTypeVideo && media.GroupID == s.Video {
+         medias = append(medias, media)
+      }
+   }
+   return medias
+}
+
+// StreamsUsingGroup returns the streams that reference groupID through
+// AUDIO, VIDEO, SUBTITLES or CLOSED-CAPTIONS, that is the streams that would
+// break if the group were removed. It returns nil if none does.
+func (mp *MasterPlaylist) StreamsUsingGroup(groupID string) []*StreamInf {
+   var streams []*StreamInf
+   for _, stream := range mp.StreamInfs {
+      uses := stream.Video == groupID ||
+         stream.Subtitles == groupID ||
+         stream.ClosedCaptions == groupID
+      for _, group := range stream.Audio {
+         if group == groupID {
+            uses = true
+         }
+      }
+      if uses {
+         streams = append(streams, stream)
+      }
+   }
+   return streams
+}
+
+// HasMuxedAudio reports whether any stream IsMuxedAudio.
+func (mp *MasterPlaylist) HasMuxedAudio() bool {
+   for _, stream := range mp.StreamInfs {
+      if stream.IsMuxedAudio() {
+         return true
+      }
+   }
+   return false
+}
+
+// IsSubtitleOnly reports whether the playlist is a subtitle or caption
+// sidecar: it has at least one media, all of them SUBTITLES or
+// CLOSED-CAPTIONS, and no stream that may carry video or audio. A stream
+// only qualifies if it has no RESOLUTION or VIDEO group and CODECS lists
+// nothing but subtitle codecs.
+func (mp *MasterPlaylist) IsSubtitleOnly() bool {
+   if len(mp.Medias) == 0 {
+      return false
+   }
+   for _, media := range mp.Medias {
+      switch media.MediaType() {
+      case MediaTypeSubtitles, MediaTypeClosedCaptions:
+      default:
+         return false
+      }
+   }
+   for _, stream := range mp.StreamInfs {
+      codecs := stream.CodecList()
+      if stream.Resolution != "" || stream.Video != "" || len(codecs) == 0 {
+         return false
+      }
+      for _, codec := range codecs {
+         if !isTextCodec(codec) {
+            return false
+         }
+      }
+   }
+   return true
+}
+
+// AudioOnlyStreams returns the streams for which IsAudioOnly is true.
+func (mp *MasterPlaylist) AudioOnlyStreams() []*StreamInf {
+   var streams []*StreamInf
+   for _, stream := range mp.StreamInfs {
+      if stream.IsAudioOnly() {
+         streams = append(streams, stream)
+      }
+   }
+   return streams
+}
+
+// VideoStreams returns the streams for which IsAudioOnly is false.
+func (mp *MasterPlaylist) VideoStreams() []*StreamInf {
+   var streams []*StreamInf
+   for _, stream := range mp.StreamInfs {
+      if !stream.IsAudioOnly() {
+         streams = append(streams, stream)
+      }
+   }
+   return streams
+}
+
+// AllCodecs returns the sorted, de-duplicated CODECS entries of every stream,
+// audio codecs included, for checking up front whether a device supports
+// anything in the presentation.
+func (mp *MasterPlaylist) AllCodecs() []string {
+   seen := make(map[string]bool)
+   var codecs []string
+   for _, stream := range mp.StreamInfs {
+      for _, codec := range stream.CodecList() {
+         if !seen[codec] {
+            seen[codec] = true
+            codecs = append(codecs, codec)
+         }
+      }
+   }
+   sort.Strings(codecs)
+   return codecs
+}
+
+// Resolution is a video width and height in pixels.
+type Resolution struct {
+   Width  int
+   Height int
+}
+
+// Resolutions returns the distinct resolutions of the streams, largest
+// first, ordered by height and then width. Audio-only streams and streams
+// without a valid RESOLUTION are skipped, so an audio-only playlist yields
+// nil.
+func (mp *MasterPlaylist) Resolutions() []Resolution {
+   seen := make(map[Resolution]bool)
+   var resolutions []Resolution
+   for _, stream := range mp.StreamInfs {
+      if stream.IsAudioOnly() {
+         continue
+      }
+      resolution := Resolution{Width: stream.Width(), Height: stream.Height()}
+      if resolution.Width <= 0 || resolution.Height <= 0 || seen[resolution] {
+         continue
+      }
+      seen[resolution] = true
+      resolutions = append(resolutions, resolution)
+   }
+   sort.Slice(resolutions, func(i, j int) bool {
+      a, b := resolutions[i], resolutions[j]
+      if a.Height != b.Height {
+         return a.Height > b.Height
+      }
+      return a.Width > b.Width
+   })
+   return resolutions
+}
+
+// FilterStreams returns a copy of the playlist with only the streams for which
+// keep returns true, and only the renditions in groups those streams still
+// reference. The original is not modified.
+func (mp *MasterPlaylist) FilterStreams(keep func(*StreamInf) bool) *MasterPlaylist {
+   filtered := &MasterPlaylist{
+      Version:             mp.Version,
+      IndependentSegments: mp.IndependentSegments,
+   }
+   if mp.Start != nil {
+      start := *mp.Start
+      filtered.Start = &start
+   }
+   groups := make(map[string]bool)
+   for _, stream := range mp.StreamInfs {
+      if !keep(stream) {
+         continue
+      }
+      newStream := *stream
+      newStream.Audio = append([]string(nil), stream.Audio...)
+      filtered.StreamInfs = append(filtered.StreamInfs, &newStream)
+      for _, group := range stream.Audio {
+         groups[group] = true
+      }
+      groups[stream.Video] = true
+      groups[stream.Subtitles] = true
+      groups[stream.ClosedCaptions] = true
+   }
+   for _, stream := range mp.IFrameStreams {
+      newStream := *stream
+      filtered.IFrameStreams = append(filtered.IFrameStreams, &newStream)
+   }
+   for _, media := range mp.Medias {
+      if groups[media.GroupID] {
+         newMedia := *media
+         filtered.Medias = append(filtered.Medias, &newMedia)
+      }
+   }
+   for _, data := range mp.SessionData {
+      newData := *data
+      filtered.SessionData = append(filtered.SessionData, &newData)
+   }
+   for _, keyItem := range mp.SessionKeys {
+      newKey := *keyItem
+      filtered.SessionKeys = append(filtered.SessionKeys, &newKey)
+   }
+   return filtered
+}
+
+// SplitByVideoCodec returns one playlist per video codec, keyed by the base
+// sample entry type of the first video CODECS entry, such as "avc1" or
+// "hvc1". Each is built with FilterStreams, so unreferenced renditions are
+// pruned and session data and keys are kept. Audio-only streams are
+// included in every playlist; streams without CODECS are in none. The same
+// goes for I-frame streams, so each playlist only advertises its own codec.
+func (mp *MasterPlaylist) SplitByVideoCodec() map[string]*MasterPlaylist {
+   split := make(map[string]*MasterPlaylist)
+   for _, stream := range mp.StreamInfs {
+      fourcc := stream.videoCodec()
+      if fourcc == "" || split[fourcc] != nil {
+         continue
+      }
+      filtered := mp.FilterStreams(func(s *StreamInf) bool {
+         return s.videoCodec() == fourcc || s.IsAudioOnly()
+      })
+      var frames []*StreamInf
+      for _, frame := range filtered.IFrameStreams {
+         if frame.videoCodec() == fourcc {
+            frames = append(frames, frame)
+         }
+      }
+      filtered.IFrameStreams = frames
+      split[fourcc] = filtered
+   }
+   return split
+}
+
+// TrimLadder returns a copy of the playlist keeping only the keepLowest and
+// keepHighest streams by EffectiveBandwidth, pruning renditions no longer
+// referenced. At least the lowest stream is always kept.
+func (mp *MasterPlaylist) TrimLadder(keepLowest, keepHighest int) *MasterPlaylist {
+   streams := append([]*StreamInf(nil), mp.StreamInfs...)
+   sort.SliceStable(streams, func(i, j int) bool {
+      return streams[i].EffectiveBandwidth() < streams[j].EffectiveBandwidth()
+   })
+   kept := make(map[*StreamInf]bool)
+   for i, stream := range streams {
+      if i < keepLowest || i >= len(streams)-keepHighest {
+         kept[stream] = true
+      }
+   }
+   if len(kept) == 0 && len(streams) > 0 {
+      kept[streams[0]] = true
+   }
+   return mp.FilterStreams(func(s *StreamInf) bool {
+      return kept[s]
    })
 }
 
+// SelectForThroughput returns the highest stream whose EffectiveBandwidth
+// fits in safetyFactor times kbps kilobits per second, such as 0.8 to leave
+// 20% headroom. If none fits it returns the lowest stream. It returns nil only
+// if there are no streams.
+func (mp *MasterPlaylist) SelectForThroughput(kbps int, safetyFactor float64) *StreamInf {
+   var best, lowest *StreamInf
+   for _, stream := range mp.StreamInfs {
+      bandwidth := stream.EffectiveBandwidth()
+      if lowest == nil || bandwidth < lowest.EffectiveBandwidth() {
+         lowest = stream
+      }
+      if float64(bandwidth) > float64(kbps)*1000*safetyFactor {
+         continue
+      }
+      if best == nil || bandwidth > best.EffectiveBandwidth() {
+         best = stream
+      }
+   }
+   if best == nil {
+      return lowest
+   }
+   return best
+}
+
+// SelectStreamForDisplay returns the highest stream by EffectiveBandwidth
+// that fits in maxBandwidth bits per second and maxHeight lines, preferring
+// one whose frame rate divides evenly into displayFPS, as other rates judder.
+// A stream without a FRAME-RATE is not assumed to judder, and one without a
+// RESOLUTION fits any height. If every fitting stream declares an unsuitable
+// frame rate it falls back to bandwidth alone, and if none fits at all it
+// returns the lowest stream, like SelectForThroughput.
+func (mp *MasterPlaylist) SelectStreamForDisplay(maxBandwidth, maxHeight int, displayFPS float64) *StreamInf {
+   var best, smooth, lowest *StreamInf
+   for _, stream := range mp.StreamInfs {
+      bandwidth := stream.EffectiveBandwidth()
+      if lowest == nil || bandwidth < lowest.EffectiveBandwidth() {
+         lowest = stream
+      }
+      if bandwidth > int64(maxBandwidth) || stream.Height() > maxHeight {
+         continue
+      }
+      if best == nil || bandwidth > best.EffectiveBandwidth() {
+         best = stream
+      }
+      if fps := stream.FrameRateValue(); fps > 0 && !fitsRefreshRate(fps, displayFPS) {
+         continue
+      }
+      if smooth == nil || bandwidth > smooth.EffectiveBandwidth() {
+         smooth = stream
+      }
+   }
+   switch {
+   case smooth != nil:
+      return smooth
+   case best != nil:
+      return best
+   }
+   return lowest
+}
+
+// fitsRefreshRate reports whether a display refreshing displayFPS times a
+// second can show every frame of fps for the same number of refreshes.
+func fitsRefreshRate(fps, displayFPS float64) bool {
+   if fps <= 0 || displayFPS < fps {
+      return false
+   }
+   ratio := displayFPS / fps
+   return math.Abs(ratio-math.Round(ratio)) < 0.01
+}
+
+// EstimateRenditionBandwidth estimates the bits per second an AUDIO
+// rendition adds to a variant, which BANDWIDTH includes but the rendition
+// does not declare. It pairs each stream that references the rendition's
+// group with video-only streams of the same RESOLUTION and video codec.
+// Streams using another AUDIO group and muxed streams are never paired, as
+// their BANDWIDTH includes other audio. It assumes the video in each pair is
+// encoded the same, so that the difference in BANDWIDTH is the audio. The
+// estimate is the average of the positive differences. It returns 0 when no
+// such pair exists or m is not audio.
+func (mp *MasterPlaylist) EstimateRenditionBandwidth(m *Media) int64 {
+   if m.MediaType() != MediaTypeAudio {
+      return 0
+   }
+   uses := func(s *StreamInf) bool {
+      for _, group := range s.Audio {
+         if group == m.GroupID {
+            return true
+         }
+      }
+      return false
+   }
+   var total, count int64
+   for _, with := range mp.StreamInfs {
+      if !uses(with) {
+         continue
+      }
+      for _, without := range mp.StreamInfs {
+         if len(without.Audio) > 0 || without.IsMuxedAudio() ||
+            without.Resolution != with.Resolution ||
+            without.videoCodec() != with.videoCodec() {
+            continue
+         }
+         if difference := with.Bandwidth - without.Bandwidth; difference > 0 {
+            total += difference
+            count++
+         }
+      }
+   }
+   if count == 0 {
+      return 0
+   }
+   return total / count
+}
+
+// SelectStreamBySeed picks a stream for seed, for assigning users to
+// variants when A/B testing encoding ladders. It is not adaptive bitrate
+// selection, just deterministic bucketing: the seed is hashed and the hash
+// picks among the streams in ID order, so the same seed and ladder always
+// yield the same stream, whatever the order of the tags. It returns nil if
+// there are no streams.
+func (mp *MasterPlaylist) SelectStreamBySeed(seed uint64) *StreamInf {
+   if len(mp.StreamInfs) == 0 {
+      return nil
+   }
+   streams := append([]*StreamInf(nil), mp.StreamInfs...)
+   sort.Slice(streams, func(i, j int) bool {
+      return streams[i].ID < streams[j].ID
+   })
+   hash := fnv.New64a()
+   binary.Write(hash, binary.BigEndian, seed)
+   return streams[hash.Sum64()%uint64(len(streams))]
+}
+
+// DefaultRendition returns the DEFAULT=YES rendition of a group. It returns
+// nil if the group has none, or more than one, which Validate reports.
+func (mp *MasterPlaylist) DefaultRendition(groupID string) *Media {
+   var found *Media
+   for _, media := range mp.Medias {
+      if media.GroupID != groupID || !media.Default {
+         continue
+      }
+      if found != nil {
+         return nil
+      }
+      found = media
+   }
+   return found
+}
+
+// AutoSelectRendition picks a rendition of a group the way a player should
+// without user input: the first AUTOSELECT=YES rendition whose LANGUAGE
+// matches preferredLang, as LanguageMatches decides, then the DEFAULT=YES
+// rendition, then the first AUTOSELECT=YES rendition, then the first
+// rendition. It returns nil if the group has no renditions.
+func (mp *MasterPlaylist) AutoSelectRendition(groupID, preferredLang string) *Media {
+   var group []*Media
+   for _, media := range mp.Medias {
+      if groupID != "" && media.GroupID == groupID {
+         group = append(group, media)
+      }
+   }
+   if len(group) == 0 {
+      return nil
+   }
+   if preferredLang != "" {
+      for _, media := range group {
+         if media.AutoSelect && media.LanguageMatches(preferredLang) {
+            return media
+         }
+      }
+   }
+   for _, media := range group {
+      if media.Default {
+         return media
+      }
+   }
+   for _, media := range group {
+      if media.AutoSelect {
+         return media
+      }
+   }
+   return group[0]
+}
+
+// AudioForStream returns the audio rendition to play with stream s: the
+// AutoSelectRendition of its first AUDIO group. If the stream's URI came
+// with several EXT-X-STREAM-INF tags, that is the group of the first one.
+// It returns nil if the stream has no AUDIO group.
+func (mp *MasterPlaylist) AudioForStream(s *StreamInf, preferredLang string) *Media {
+   if len(s.Audio) == 0 {
+      return nil
+   }
+   return mp.AutoSelectRendition(s.Audio[0], preferredLang)
+}
+
+// SubtitleTracks returns the SUBTITLES renditions across all groups, keeping
+// the first rendition for each URI. GroupID maps a track back to its streams.
+func (mp *MasterPlaylist) SubtitleTracks() []*Media {
+   var tracks []*Media
+   seen := make(map[string]bool)
+   for _, media := range mp.Medias {
+      if media.MediaType() != MediaTypeSubtitles || media.URI == nil {
+         continue
+      }
+      if uri := media.URI.String(); !seen[uri] {
+         seen[uri] = true
+         tracks = append(tracks, media)
+      }
+   }
+   return tracks
+}
+
+// MediaType is the TYPE attribute of an #EXT-X-MEDIA tag.
+type MediaType string
+
+const (
+   MediaTypeAudio          MediaType = "AUDIO"
+   MediaTypeVideo          MediaType = "VIDEO"
+   MediaTypeSubtitles      MediaType = "SUBTITLES"
+   MediaTypeClosedCaptions MediaType = "CLOSED-CAPTIONS"
+)
+
+// Valid reports whether t is one of the types defined by the spec.
+func (t MediaType) Valid() bool {
+   switch t {
+   case MediaTypeAudio, MediaTypeVideo, MediaTypeSubtitles, MediaTypeClosedCaptions:
+      return true
+   }
+   return false
+}
+
 // Media represents an #EXT-X-MEDIA tag.
 type Media struct {
-   Type            string
-   GroupID         string
-   Name            string
-   Language        string
-   URI             *url.URL
-   AutoSelect      bool
-   Default         bool
-   Forced          bool
-   Channels        string
-   Characteristics string
-   ID              int
+   Type              string
+   GroupID           string
+   Name              string
+   Language          string
+   AssocLanguage     string
+   URI               *url.URL
+   AutoSelect        bool
+   Default           bool
+   Forced            bool // Only ever set on SUBTITLES renditions
+   Channels          string
+   Characteristics   string
+   InstreamID        string
+   StableRenditionID string // STABLE-RENDITION-ID, shared across pathways
+   ID                int    // See MasterPlaylist for how IDs are assigned
+   SourceLine        int    // Line of the #EXT-X-MEDIA tag
+}
+
+// MediaType returns Type as a MediaType.
+func (r *Media) MediaType() MediaType {
+   return MediaType(r.Type)
+}
+
+// CharacteristicList returns the entries of Characteristics, the Uniform
+// Type Identifiers such as "public.accessibility.describes-video".
+func (r *Media) CharacteristicList() []string {
+   return splitCodecs(r.Characteristics)
+}
+
+// HasCharacteristic reports whether Characteristics includes characteristic.
+func (r *Media) HasCharacteristic(characteristic string) bool {
+   for _, entry := range r.CharacteristicList() {
+      if entry == characteristic {
+         return true
+      }
+   }
+   return false
 }
 
 // String returns a multi-line summary of the Media.
@@ -128,20 +940,76 @@ func (r *Media) String() string {
    return builder.String()
 }
 
-func parseMaster(lines []string) (*MasterPlaylist, error) {
-   masterPlaylist := &MasterPlaylist{}
-   streamCounter := 0
+func parseMaster(lines []string, numbers []int, opts *DecodeOptions) (*MasterPlaylist, error) {
+   // Without #EXT-X-VERSION a playlist is version 1
+   masterPlaylist := &MasterPlaylist{Version: 1}
+   if opts.Stats != nil {
+      opts.Stats.LineCount += len(lines)
+   }
    streamMap := make(map[string]*StreamInf) // Map URL to StreamInf to handle grouping
+   var header bool
 
    for i := 0; i < len(lines); i++ {
       line := lines[i]
-      if strings.HasPrefix(line, "#EXT-X-MEDIA:") {
-         media := parseMediaTag(line)
-         media.ID = streamCounter
-         streamCounter++
+      if line == "#EXTM3U" {
+         if header && opts.Strict {
+            return nil, errors.New("unexpected second #EXTM3U")
+         }
+         header = true
+      } else if strings.HasPrefix(line, "#EXT-X-VERSION:") {
+         version, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-VERSION:"))
+         if err != nil {
+            return nil, fmt.Errorf("invalid EXT-X-VERSION: %w", err)
+         }
+         masterPlaylist.Version = version
+      } else if line == "#EXT-X-INDEPENDENT-SEGMENTS" {
+         masterPlaylist.IndependentSegments = true
+      } else if strings.HasPrefix(line, "#EXT-X-START:") {
+         start, err := parseStart(line, opts.Strict)
+         if err != nil {
+            return nil, err
+         }
+         masterPlaylist.Start = start
+      } else if strings.HasPrefix(line, "#EXT-X-MEDIA:") {
+         media, err := parseMediaTag(line, opts)
+         if err != nil {
+            return nil, err
+         }
+         media.SourceLine = numbers[i]
          masterPlaylist.Medias = append(masterPlaylist.Medias, media)
+      } else if strings.HasPrefix(line, "#EXT-X-SESSION-DATA:") {
+         data, err := parseSessionData(line, opts)
+         if err != nil {
+            return nil, err
+         }
+         data.SourceLine = numbers[i]
+         masterPlaylist.SessionData = append(masterPlaylist.SessionData, data)
+      } else if strings.HasPrefix(line, "#EXT-X-SESSION-KEY:") {
+         key, err := parseKey(line, "#EXT-X-SESSION-KEY:", opts)
+         if err != nil {
+            return nil, err
+         }
+         key.SourceLine = numbers[i]
+         masterPlaylist.SessionKeys = append(masterPlaylist.SessionKeys, key)
+      } else if strings.HasPrefix(line, "#EXT-X-I-FRAME-STREAM-INF:") {
+         attrs, err := parseAttributes(line, "#EXT-X-I-FRAME-STREAM-INF:", opts.Strict)
+         if err != nil {
+            return nil, err
+         }
+         stream := &StreamInf{SourceLine: numbers[i]}
+         populateStreamInfAttributes(stream, attrs)
+         if value, ok := attrs["URI"]; ok && value != "" {
+            stream.URI, err = opts.parseURI(value)
+            if err != nil {
+               return nil, err
+            }
+         }
+         masterPlaylist.IFrameStreams = append(masterPlaylist.IFrameStreams, stream)
       } else if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
-         attrs := parseAttributes(line, "#EXT-X-STREAM-INF:")
+         attrs, err := parseAttributes(line, "#EXT-X-STREAM-INF:", opts.Strict)
+         if err != nil {
+            return nil, err
+         }
 
          if i+1 >= len(lines) { // Malformed, missing URI
             continue
@@ -152,10 +1020,10 @@ func parseMaster(lines []string) (*MasterPlaylist, error) {
          stream, exists := streamMap[uriLine]
          if !exists {
             // First time seeing this URI, create a new StreamInf
-            stream = &StreamInf{ID: streamCounter}
-            streamCounter++
-            if parsedURL, err := url.Parse(uriLine); err == nil {
-               stream.URI = parsedURL
+            stream = &StreamInf{SourceLine: numbers[i-1]}
+            stream.URI, err = opts.parseURI(uriLine)
+            if err != nil {
+               return nil, err
             }
             streamMap[uriLine] = stream
             masterPlaylist.StreamInfs = append(masterPlaylist.StreamInfs, stream)
@@ -169,43 +1037,123 @@ func parseMaster(lines []string) (*MasterPlaylist, error) {
             stream.Audio = append(stream.Audio, audioGroup)
          }
 
-         // Check if this variant has a lower bandwidth than the one stored.
-         // If so, update the stream's primary attributes.
-         if bw, _ := strconv.Atoi(attrs["BANDWIDTH"]); exists && bw < stream.Bandwidth {
-            populateStreamInfAttributes(stream, attrs)
+         // Check if this variant has a lower bandwidth than the one stored,
+         // ordered the same way as SortBandwidth. If so, update the stream's
+         // primary attributes.
+         if exists {
+            var variant StreamInf
+            populateStreamInfAttributes(&variant, attrs)
+            if variant.lowerThan(stream) {
+               populateStreamInfAttributes(stream, attrs)
+            }
+         }
+      } else {
+         handled, err := opts.handleMaster(line, masterPlaylist)
+         if err != nil {
+            return nil, err
+         }
+         if !handled {
+            opts.unrecognized(line, numbers[i])
          }
       }
    }
+   masterPlaylist.assignIDs()
    return masterPlaylist, nil
 }
 
+// assignIDs numbers streams then medias in an order that depends only on
+// their content.
+func (mp *MasterPlaylist) assignIDs() {
+   streams := append([]*StreamInf(nil), mp.StreamInfs...)
+   sort.SliceStable(streams, func(i, j int) bool {
+      return uriString(streams[i].URI) < uriString(streams[j].URI)
+   })
+   medias := append([]*Media(nil), mp.Medias...)
+   sort.SliceStable(medias, func(i, j int) bool {
+      a, b := medias[i], medias[j]
+      if uriA, uriB := uriString(a.URI), uriString(b.URI); uriA != uriB {
+         return uriA < uriB
+      }
+      if a.Type != b.Type {
+         return a.Type < b.Type
+      }
+      if a.GroupID != b.GroupID {
+         return a.GroupID < b.GroupID
+      }
+      if a.Name != b.Name {
+         return a.Name < b.Name
+      }
+      return a.Language < b.Language
+   })
+   id := 0
+   for _, stream := range streams {
+      stream.ID = id
+      id++
+   }
+   for _, media := range medias {
+      media.ID = id
+      id++
+   }
+}
+
+// uriString returns the string form of u, or "" if u is nil.
+func uriString(u *url.URL) string {
+   if u == nil {
+      return ""
+   }
+   return u.String()
+}
+
 // populateStreamInfAttributes updates a StreamInf's fields from a map of attributes.
 func populateStreamInfAttributes(stream *StreamInf, attrs map[string]string) {
    stream.Codecs = attrs["CODECS"]
+   stream.SupplementalCodecs = attrs["SUPPLEMENTAL-CODECS"]
    stream.Resolution = attrs["RESOLUTION"]
    stream.FrameRate = attrs["FRAME-RATE"]
+   stream.VideoLayout = attrs["REQ-VIDEO-LAYOUT"]
+   stream.Video = attrs["VIDEO"]
    stream.Subtitles = attrs["SUBTITLES"]
-   stream.Bandwidth, _ = strconv.Atoi(attrs["BANDWIDTH"])
-   stream.AverageBandwidth, _ = strconv.Atoi(attrs["AVERAGE-BANDWIDTH"])
+   stream.ClosedCaptions = attrs["CLOSED-CAPTIONS"]
+   stream.StableVariantID = attrs["STABLE-VARIANT-ID"]
+   stream.PathwayID = attrs["PATHWAY-ID"]
+   stream.Bandwidth, _ = strconv.ParseInt(attrs["BANDWIDTH"], 10, 64)
+   stream.AverageBandwidth, _ = strconv.ParseInt(attrs["AVERAGE-BANDWIDTH"], 10, 64)
 }
 
-func parseMediaTag(line string) *Media {
-   attrs := parseAttributes(line, "#EXT-X-MEDIA:")
+func parseMediaTag(line string, opts *DecodeOptions) (*Media, error) {
+   attrs, err := parseAttributes(line, "#EXT-X-MEDIA:", opts.Strict)
+   if err != nil {
+      return nil, err
+   }
    newMedia := &Media{
-      Type:            attrs["TYPE"],
-      GroupID:         attrs["GROUP-ID"],
-      Name:            attrs["NAME"],
-      Language:        attrs["LANGUAGE"],
-      Channels:        attrs["CHANNELS"],
-      Characteristics: attrs["CHARACTERISTICS"],
-      AutoSelect:      attrs["AUTOSELECT"] == "YES",
-      Default:         attrs["DEFAULT"] == "YES",
-      Forced:          attrs["FORCED"] == "YES",
+      Type:              attrs["TYPE"],
+      GroupID:           attrs["GROUP-ID"],
+      Name:              attrs["NAME"],
+      Language:          attrs["LANGUAGE"],
+      AssocLanguage:     attrs["ASSOC-LANGUAGE"],
+      Channels:          attrs["CHANNELS"],
+      Characteristics:   attrs["CHARACTERISTICS"],
+      InstreamID:        attrs["INSTREAM-ID"],
+      StableRenditionID: attrs["STABLE-RENDITION-ID"],
+      AutoSelect:        attrs["AUTOSELECT"] == "YES",
+      Default:           attrs["DEFAULT"] == "YES",
+      Forced:            attrs["FORCED"] == "YES",
+   }
+   if opts.Strict && !newMedia.MediaType().Valid() {
+      return nil, fmt.Errorf("invalid EXT-X-MEDIA TYPE: %q", newMedia.Type)
+   }
+   // FORCED is only defined for SUBTITLES
+   if newMedia.Forced && newMedia.MediaType() != MediaTypeSubtitles {
+      if opts.Strict {
+         return nil, fmt.Errorf("EXT-X-MEDIA FORCED on TYPE %s", newMedia.Type)
+      }
+      newMedia.Forced = false
    }
    if value, ok := attrs["URI"]; ok && value != "" {
-      if parsedURL, err := url.Parse(value); err == nil {
-         newMedia.URI = parsedURL
+      newMedia.URI, err = opts.parseURI(value)
+      if err != nil {
+         return nil, err
       }
    }
-   return newMedia
+   return newMedia, nil
 }
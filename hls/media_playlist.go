@@ -1,21 +1,134 @@
 package hls
 
 import (
+   "errors"
    "fmt"
+   "math"
    "net/url"
+   "path"
    "strconv"
    "strings"
+   "time"
 )
 
 type MediaPlaylist struct {
    TargetDuration int
-   MediaSequence  int
-   Version        int
-   PlaylistType   string
-   Segments       []*Segment
-   Keys           []*Key   // A slice of all keys found in the playlist
-   Map            *url.URL // The playlist's initialization map
-   EndList        bool
+   // TargetDurationEstimated is set when the playlist had no
+   // #EXT-X-TARGETDURATION and TargetDuration was estimated as the longest
+   // segment duration rounded up. Strict decoding rejects such playlists.
+   TargetDurationEstimated bool
+   MediaSequence           int
+   Version                 int
+   PlaylistType            string
+   PartTarget              float64 // PART-TARGET from #EXT-X-PART-INF, in seconds
+   IndependentSegments     bool    // from #EXT-X-INDEPENDENT-SEGMENTS
+   // IFramesOnly is set by #EXT-X-I-FRAMES-ONLY. Each segment is then a
+   // single I-frame, usually a byte range of a regular segment, and its
+   // duration lasts until the next I-frame.
+   IFramesOnly bool
+   Start       *Start // nil without #EXT-X-START
+   Segments    []*Segment
+   Keys        []*Key   // A slice of all keys found in the playlist
+   Map         *url.URL // The last initialization map in the playlist
+   Maps        []*Map   // All distinct initialization maps, in order
+   DateRanges  []*DateRange
+   EndList     bool
+}
+
+// MediaHeader is the part of a Media Playlist that comes before the first
+// segment.
+type MediaHeader struct {
+   Version             int
+   TargetDuration      int
+   MediaSequence       int
+   PlaylistType        string
+   PartTarget          float64
+   IndependentSegments bool
+   IFramesOnly         bool
+   Start               *Start
+   Keys                []*Key // keys declared before the first segment
+   Map                 *Map   // the map in scope at the first segment
+}
+
+// Header returns the playlist's header, so tooling can compare headers across
+// reloads of a live playlist without the segments getting in the way. Keys
+// and the map are shared with the playlist.
+func (mp *MediaPlaylist) Header() *MediaHeader {
+   header := &MediaHeader{
+      Version:             mp.Version,
+      TargetDuration:      mp.TargetDuration,
+      MediaSequence:       mp.MediaSequence,
+      PlaylistType:        mp.PlaylistType,
+      PartTarget:          mp.PartTarget,
+      IndependentSegments: mp.IndependentSegments,
+      IFramesOnly:         mp.IFramesOnly,
+      Start:               mp.Start,
+   }
+   for _, keyItem := range mp.Keys {
+      if len(mp.Segments) > 0 && keyItem.SourceLine > mp.Segments[0].SourceLine {
+         break
+      }
+      header.Keys = append(header.Keys, keyItem)
+   }
+   if len(mp.Segments) > 0 {
+      header.Map = mp.Segments[0].Map
+   } else if len(mp.Maps) > 0 {
+      header.Map = mp.Maps[len(mp.Maps)-1]
+   }
+   return header
+}
+
+// Equal reports whether h and other have the same values. MediaSequence is
+// compared too, so a sliding live window always differs; clear it first to
+// look at the other tags only.
+func (h *MediaHeader) Equal(other *MediaHeader) bool {
+   if h.Version != other.Version ||
+      h.TargetDuration != other.TargetDuration ||
+      h.MediaSequence != other.MediaSequence ||
+      h.PlaylistType != other.PlaylistType ||
+      h.PartTarget != other.PartTarget ||
+      h.IndependentSegments != other.IndependentSegments ||
+      h.IFramesOnly != other.IFramesOnly {
+      return false
+   }
+   if (h.Start == nil) != (other.Start == nil) ||
+      h.Start != nil && *h.Start != *other.Start {
+      return false
+   }
+   if len(h.Keys) != len(other.Keys) || (h.Map == nil) != (other.Map == nil) {
+      return false
+   }
+   for i, keyItem := range h.Keys {
+      a, b := *keyItem, *other.Keys[i]
+      if uriString(a.URI) != uriString(b.URI) {
+         return false
+      }
+      a.URI, b.URI, a.SourceLine, b.SourceLine = nil, nil, 0, 0
+      if a != b {
+         return false
+      }
+   }
+   if h.Map != nil {
+      return uriString(h.Map.URI) == uriString(other.Map.URI) &&
+         sameByteRange(h.Map.ByteRange, other.Map.ByteRange)
+   }
+   return true
+}
+
+// ApplyMasterDefaults copies the tags that master declares on behalf of all
+// of its Media Playlists. Per RFC 8216 section 4.3.5,
+// #EXT-X-INDEPENDENT-SEGMENTS and #EXT-X-START in a Master Playlist apply to
+// every Media Playlist it references, and when both declare one the Media
+// Playlist's value is ignored if it differs. IndependentSegments is therefore
+// set if either declares it, and master's Start, if any, replaces ours.
+func (mp *MediaPlaylist) ApplyMasterDefaults(master *MasterPlaylist) {
+   if master.IndependentSegments {
+      mp.IndependentSegments = true
+   }
+   if master.Start != nil {
+      start := *master.Start
+      mp.Start = &start
+   }
 }
 
 // ResolveURIs converts relative URLs to absolute URLs using the base URL.
@@ -23,6 +136,9 @@ func (mp *MediaPlaylist) ResolveURIs(base *url.URL) {
    for _, keyItem := range mp.Keys {
       keyItem.resolve(base)
    }
+   for _, mapItem := range mp.Maps {
+      mapItem.resolve(base)
+   }
    for _, segmentItem := range mp.Segments {
       segmentItem.resolve(base)
    }
@@ -31,10 +147,762 @@ func (mp *MediaPlaylist) ResolveURIs(base *url.URL) {
    }
 }
 
+// AllAbsolute reports whether every segment, key and map URI is absolute,
+// as it should be after ResolveURIs, and returns any that are not, for
+// logging.
+func (mp *MediaPlaylist) AllAbsolute() (bool, []*url.URL) {
+   var relative []*url.URL
+   check := func(u *url.URL) {
+      if u != nil && !u.IsAbs() {
+         relative = append(relative, u)
+      }
+   }
+   for _, keyItem := range mp.Keys {
+      check(keyItem.URI)
+   }
+   for _, mapItem := range mp.Maps {
+      check(mapItem.URI)
+   }
+   for _, segmentItem := range mp.Segments {
+      check(segmentItem.URI)
+   }
+   return len(relative) == 0, relative
+}
+
+// RewritePaths replaces the path of every segment, key and map URI with the
+// result of fn, leaving the scheme, host and query untouched. fn receives and
+// returns the escaped path, so percent-encoded segments are preserved. Opaque
+// URIs such as data: keys are skipped.
+func (mp *MediaPlaylist) RewritePaths(fn func(path string) string) {
+   for _, keyItem := range mp.Keys {
+      keyItem.URI = rewritePath(keyItem.URI, fn)
+   }
+   for _, mapItem := range mp.Maps {
+      mapItem.URI = rewritePath(mapItem.URI, fn)
+   }
+   for _, segmentItem := range mp.Segments {
+      segmentItem.URI = rewritePath(segmentItem.URI, fn)
+   }
+   mp.Map = rewritePath(mp.Map, fn)
+}
+
+// rewritePath returns a copy of u with its path replaced by fn.
+func rewritePath(u *url.URL, fn func(string) string) *url.URL {
+   if u == nil || u.Opaque != "" {
+      return u
+   }
+   rawPath := fn(u.EscapedPath())
+   path, err := url.PathUnescape(rawPath)
+   if err != nil {
+      return u
+   }
+   rewritten := *u
+   rewritten.Path = path
+   rewritten.RawPath = rawPath
+   return &rewritten
+}
+
+// Rebase moves every segment, key and map URI from under oldBase to under
+// newBase, as a caching proxy does: the scheme, host and path prefix of
+// oldBase are replaced with those of newBase, and the rest of the path, the
+// query and the fragment are kept, so signed tokens survive. Opaque URIs such
+// as data: keys are skipped. If a URI is not under oldBase, Rebase returns an
+// error and changes nothing. Call ResolveURIs first if the URIs are relative.
+func (mp *MediaPlaylist) Rebase(oldBase, newBase *url.URL) error {
+   var targets []**url.URL
+   for _, keyItem := range mp.Keys {
+      targets = append(targets, &keyItem.URI)
+   }
+   for _, mapItem := range mp.Maps {
+      targets = append(targets, &mapItem.URI)
+   }
+   for _, segmentItem := range mp.Segments {
+      targets = append(targets, &segmentItem.URI)
+   }
+   targets = append(targets, &mp.Map)
+   rebased := make([]*url.URL, len(targets))
+   for i, target := range targets {
+      u := *target
+      if u == nil || u.Opaque != "" {
+         rebased[i] = u
+         continue
+      }
+      oldPath := oldBase.EscapedPath()
+      rest, ok := strings.CutPrefix(u.EscapedPath(), oldPath)
+      // The prefix must end at a path segment, so /v1 is not under /v10
+      if ok && rest != "" && !strings.HasPrefix(rest, "/") && !strings.HasSuffix(oldPath, "/") {
+         ok = false
+      }
+      if !ok || u.Scheme != oldBase.Scheme || u.Host != oldBase.Host {
+         return fmt.Errorf("%s is not under %s", u, oldBase)
+      }
+      moved := *u
+      moved.Scheme = newBase.Scheme
+      moved.Host = newBase.Host
+      moved.User = newBase.User
+      // Join with exactly one slash at the boundary
+      rawPath := newBase.EscapedPath()
+      switch {
+      case rest == "":
+      case strings.HasSuffix(rawPath, "/") && strings.HasPrefix(rest, "/"):
+         rest = rest[1:]
+      case !strings.HasSuffix(rawPath, "/") && !strings.HasPrefix(rest, "/"):
+         rawPath += "/"
+      }
+      rawPath += rest
+      path, err := url.PathUnescape(rawPath)
+      if err != nil {
+         return err
+      }
+      moved.Path = path
+      moved.RawPath = rawPath
+      rebased[i] = &moved
+   }
+   for i, target := range targets {
+      *target = rebased[i]
+   }
+   return nil
+}
+
+// StripEncryption returns a copy of the playlist with every #EXT-X-KEY
+// removed, for serving segments that were decrypted ahead of time. With no
+// keys left no METHOD=NONE is needed. The original is not modified.
+func (mp *MediaPlaylist) StripEncryption() *MediaPlaylist {
+   clone := mp.clone()
+   clone.Keys = nil
+   for _, segment := range clone.Segments {
+      segment.Key = nil
+      segment.Keys = nil
+   }
+   return clone
+}
+
+// AppendFrom checks that mp, a reload of an EVENT playlist, only appended to
+// previous, and returns a copy of the combined playlist. Unlike a live sliding
+// window, an EVENT playlist never removes segments, so the Media Sequence
+// Number must be unchanged and the segments of previous must be a prefix of
+// those of mp. It returns an error if either playlist is not of type EVENT or
+// if the invariants are violated. Neither playlist is modified.
+func (mp *MediaPlaylist) AppendFrom(previous *MediaPlaylist) (*MediaPlaylist, error) {
+   if mp.PlaylistType != "EVENT" || previous.PlaylistType != "EVENT" {
+      return nil, errors.New("AppendFrom requires EXT-X-PLAYLIST-TYPE:EVENT")
+   }
+   if mp.MediaSequence != previous.MediaSequence {
+      return nil, fmt.Errorf(
+         "EXT-X-MEDIA-SEQUENCE changed from %d to %d",
+         previous.MediaSequence, mp.MediaSequence,
+      )
+   }
+   if len(previous.Segments) > len(mp.Segments) {
+      return nil, fmt.Errorf(
+         "segment count went from %d to %d", len(previous.Segments), len(mp.Segments),
+      )
+   }
+   for i, old := range previous.Segments {
+      if !sameSegment(old, mp.Segments[i]) {
+         return nil, fmt.Errorf(
+            "segment %d (line %d): does not match the previous playlist",
+            i, mp.Segments[i].SourceLine,
+         )
+      }
+   }
+   return mp.clone(), nil
+}
+
+// sameSegment reports whether a and b refer to the same media.
+func sameSegment(a, b *Segment) bool {
+   if uriString(a.URI) != uriString(b.URI) || a.Duration != b.Duration {
+      return false
+   }
+   return sameByteRange(a.ByteRange, b.ByteRange)
+}
+
+// sameByteRange reports whether a and b are both nil or the same range.
+func sameByteRange(a, b *ByteRange) bool {
+   if a == nil || b == nil {
+      return a == b
+   }
+   return *a == *b
+}
+
+// clone returns a deep copy of the playlist.
+func (mp *MediaPlaylist) clone() *MediaPlaylist {
+   clone := *mp
+   if mp.Start != nil {
+      start := *mp.Start
+      clone.Start = &start
+   }
+   if mp.Map != nil {
+      mapURL := *mp.Map
+      clone.Map = &mapURL
+   }
+   keys := make(map[*Key]*Key, len(mp.Keys))
+   clone.Keys = make([]*Key, len(mp.Keys))
+   for i, keyItem := range mp.Keys {
+      newKey := *keyItem
+      keys[keyItem] = &newKey
+      clone.Keys[i] = &newKey
+   }
+   maps := make(map[*Map]*Map, len(mp.Maps))
+   clone.Maps = make([]*Map, len(mp.Maps))
+   for i, mapItem := range mp.Maps {
+      newMap := *mapItem
+      if mapItem.ByteRange != nil {
+         byteRange := *mapItem.ByteRange
+         newMap.ByteRange = &byteRange
+      }
+      maps[mapItem] = &newMap
+      clone.Maps[i] = &newMap
+   }
+   clone.DateRanges = make([]*DateRange, len(mp.DateRanges))
+   for i, dateRange := range mp.DateRanges {
+      newDateRange := *dateRange
+      clone.DateRanges[i] = &newDateRange
+   }
+   clone.Segments = make([]*Segment, len(mp.Segments))
+   for i, segmentItem := range mp.Segments {
+      newSegment := *segmentItem
+      if segmentItem.ByteRange != nil {
+         byteRange := *segmentItem.ByteRange
+         newSegment.ByteRange = &byteRange
+      }
+      if segmentItem.Map != nil {
+         newSegment.Map = maps[segmentItem.Map]
+      }
+      if segmentItem.Key != nil {
+         newSegment.Key = keys[segmentItem.Key]
+      }
+      if segmentItem.Keys != nil {
+         newSegment.Keys = make([]*Key, len(segmentItem.Keys))
+         for j, keyItem := range segmentItem.Keys {
+            newSegment.Keys[j] = keys[keyItem]
+         }
+      }
+      clone.Segments[i] = &newSegment
+   }
+   return &clone
+}
+
+// LiveEdge returns the most recent fully published segment. Segments are only
+// created from #EXTINF, so a trailing partial segment is never included, and
+// trailing segments whose URI line has not been published yet are skipped.
+// It returns false for VOD playlists and playlists without such a segment.
+func (mp *MediaPlaylist) LiveEdge() (*Segment, bool) {
+   if mp.EndList || mp.PlaylistType == "VOD" {
+      return nil, false
+   }
+   for i := len(mp.Segments) - 1; i >= 0; i-- {
+      if mp.Segments[i].URI != nil {
+         return mp.Segments[i], true
+      }
+   }
+   return nil, false
+}
+
+// KeyURIs returns the distinct key URIs, in order of first appearance, so a
+// downloader can fetch each key once up front. Keys with METHOD=NONE or an
+// inline data: URI are left out. Call ResolveURIs first for absolute URIs.
+func (mp *MediaPlaylist) KeyURIs() []*url.URL {
+   seen := make(map[string]bool)
+   var uris []*url.URL
+   for _, keyItem := range mp.Keys {
+      if keyItem.Method == "NONE" || keyItem.URI == nil || keyItem.URI.Scheme == "data" {
+         continue
+      }
+      if uri := keyItem.URI.String(); !seen[uri] {
+         seen[uri] = true
+         uris = append(uris, keyItem.URI)
+      }
+   }
+   return uris
+}
+
+// KeyRotationPoints returns the indexes of the segments where the keys in
+// scope change, so that a downloader can fetch each new key ahead of time;
+// the keys themselves are Segments[i].Keys. A repeated #EXT-X-KEY with the
+// same METHOD, URI and KEYFORMAT, perhaps with a new IV, is not a rotation.
+// The first segment is never a rotation point, so a playlist with one set of
+// keys or none returns nil.
+func (mp *MediaPlaylist) KeyRotationPoints() []int {
+   var points []int
+   for i := 1; i < len(mp.Segments); i++ {
+      if !sameKeys(mp.Segments[i-1].Keys, mp.Segments[i].Keys) {
+         points = append(points, i)
+      }
+   }
+   return points
+}
+
+// sameKeys reports whether two sets of keys in scope need the same keys to
+// decrypt.
+func sameKeys(a, b []*Key) bool {
+   if len(a) != len(b) {
+      return false
+   }
+   for i := range a {
+      if !sameKey(a[i], b[i]) {
+         return false
+      }
+   }
+   return true
+}
+
+// sameKey reports whether a and b need the same key to decrypt. nil and
+// METHOD=NONE are both no encryption.
+func sameKey(a, b *Key) bool {
+   aNone := a == nil || a.Method == "NONE"
+   bNone := b == nil || b.Method == "NONE"
+   if aNone || bNone {
+      return aNone == bNone
+   }
+   return a.Method == b.Method &&
+      uriString(a.URI) == uriString(b.URI) &&
+      a.KeyFormat == b.KeyFormat
+}
+
+// SegmentBitrate returns the approximate bitrate of segment i in bits per
+// second, for pacing a downloader without fetching anything: Bitrate if the
+// segment has one, otherwise the length of its byte range divided by its
+// duration. It returns 0 if neither is known or i is out of range.
+func (mp *MediaPlaylist) SegmentBitrate(i int) int {
+   return mp.SegmentBitrateForSize(i, 0)
+}
+
+// SegmentBitrateForSize is SegmentBitrate for a downloader that knows the
+// size of segment i in bytes, such as from a HEAD request. Without a Bitrate
+// the size divided by the duration is used, and then the byte range. A size
+// of 0 or less is unknown.
+func (mp *MediaPlaylist) SegmentBitrateForSize(i int, size int64) int {
+   if i < 0 || i >= len(mp.Segments) {
+      return 0
+   }
+   segment := mp.Segments[i]
+   if segment.Bitrate > 0 {
+      return segment.Bitrate * 1000
+   }
+   if size <= 0 && segment.ByteRange != nil {
+      size = segment.ByteRange.Length
+   }
+   if size > 0 && segment.Duration > 0 {
+      return int(float64(size*8) / segment.Duration)
+   }
+   return 0
+}
+
+// IsLowLatency reports whether the playlist uses Low-Latency HLS, which it
+// must declare with #EXT-X-PART-INF before listing any partial segments.
+func (mp *MediaPlaylist) IsLowLatency() bool {
+   return mp.PartTarget > 0
+}
+
+// WindowDuration returns the summed duration of the segments currently
+// listed. For a live playlist this is the length of the sliding window, the
+// range a DVR UI can seek in, which moves forward as the playlist is
+// reloaded. Gap segments are included, as they still occupy the timeline. A
+// player that holds back from the live edge can seek within slightly less.
+func (mp *MediaPlaylist) WindowDuration() time.Duration {
+   var seconds float64
+   for _, segment := range mp.Segments {
+      seconds += segment.Duration
+   }
+   return secondsToDuration(seconds)
+}
+
+// IsMonotonic reports whether the segments are consistently ordered: every
+// duration is non-negative and ProgramDateTime, where present, never goes
+// backwards. It is a diagnostic only, as reordering segments is unsafe.
+func (mp *MediaPlaylist) IsMonotonic() bool {
+   return mp.firstNonMonotonic() < 0
+}
+
+// firstNonMonotonic returns the index of the first segment that breaks the
+// ordering IsMonotonic checks, or -1 if none does.
+func (mp *MediaPlaylist) firstNonMonotonic() int {
+   var last time.Time
+   for i, segment := range mp.Segments {
+      if segment.Duration < 0 {
+         return i
+      }
+      if segment.ProgramDateTime.IsZero() {
+         continue
+      }
+      if segment.ProgramDateTime.Before(last) {
+         return i
+      }
+      last = segment.ProgramDateTime
+   }
+   return -1
+}
+
+// SequenceGaps returns the indices of segments whose ProgramDateTime is later
+// than the previous timestamp plus the durations in between, suggesting that
+// segments are missing before them. Jumps at a discontinuity are expected
+// and not reported. It returns nil when the timeline is contiguous.
+func (mp *MediaPlaylist) SequenceGaps() []int {
+   // allow for rounding in EXTINF durations
+   const tolerance = 500 * time.Millisecond
+   var gaps []int
+   var anchor time.Time
+   var elapsed float64
+   for i, segment := range mp.Segments {
+      if segment.Discontinuity {
+         anchor = time.Time{}
+      }
+      if !segment.ProgramDateTime.IsZero() {
+         if !anchor.IsZero() {
+            expected := anchor.Add(secondsToDuration(elapsed))
+            if segment.ProgramDateTime.Sub(expected) > tolerance {
+               gaps = append(gaps, i)
+            }
+         }
+         anchor = segment.ProgramDateTime
+         elapsed = 0
+      }
+      elapsed += segment.Duration
+   }
+   return gaps
+}
+
+// InterpolateProgramDateTime fills in ProgramDateTime for segments without
+// one by adding or subtracting durations from the nearest explicit value.
+// Values are never carried across a discontinuity, so a run of segments
+// between discontinuities with no explicit value is left unset.
+func (mp *MediaPlaylist) InterpolateProgramDateTime() {
+   start := 0
+   for start < len(mp.Segments) {
+      end := start + 1
+      for end < len(mp.Segments) && !mp.Segments[end].Discontinuity {
+         end++
+      }
+      interpolateRun(mp.Segments[start:end])
+      start = end
+   }
+}
+
+// interpolateRun interpolates ProgramDateTime within segments that have no
+// discontinuity between them.
+func interpolateRun(segments []*Segment) {
+   anchor := -1
+   for i, segment := range segments {
+      if !segment.ProgramDateTime.IsZero() {
+         anchor = i
+         break
+      }
+   }
+   if anchor == -1 {
+      return
+   }
+   for i := anchor - 1; i >= 0; i-- {
+      segments[i].ProgramDateTime = segments[i+1].ProgramDateTime.Add(
+         -secondsToDuration(segments[i].Duration),
+      )
+   }
+   for i := anchor + 1; i < len(segments); i++ {
+      if segments[i].ProgramDateTime.IsZero() {
+         segments[i].ProgramDateTime = segments[i-1].ProgramDateTime.Add(
+            secondsToDuration(segments[i-1].Duration),
+         )
+      }
+   }
+}
+
+// secondsToDuration converts an EXTINF style duration to a time.Duration.
+func secondsToDuration(seconds float64) time.Duration {
+   return time.Duration(seconds * float64(time.Second))
+}
+
+// InitSegmentRequests returns a request for each distinct initialization
+// map, in playlist order, with a Range header value for byte-range maps.
+func (mp *MediaPlaylist) InitSegmentRequests() []HTTPRange {
+   var requests []HTTPRange
+   for _, mapItem := range mp.Maps {
+      request := HTTPRange{URL: mapItem.URI}
+      if mapItem.ByteRange != nil {
+         request.Range = mapItem.ByteRange.RangeHeader()
+      }
+      requests = append(requests, request)
+   }
+   return requests
+}
+
+// FetchItem is one request in a FetchPlan.
+type FetchItem struct {
+   HTTPRange
+   Init           bool   // an initialization section rather than a segment
+   Key            *Key   // as in ResolvedSegment
+   Keys           []*Key // as in ResolvedSegment
+   IV             string // as in ResolvedSegment
+   Gap            bool   // a gap segment, which must be skipped
+   SequenceNumber int    // Media Sequence Number, for segments
+}
+
+// FetchPlan returns the requests needed to download the playlist, in order,
+// for a worker pool to consume. Each segment is preceded by its
+// initialization section whenever that changes. Gap segments are listed, so
+// that numbering is kept, but marked to be skipped. Key and IV are only set
+// for segments; an AES-128 encrypted initialization section is not detected.
+// Call ResolveURIs first for absolute URLs.
+func (mp *MediaPlaylist) FetchPlan() []FetchItem {
+   var plan []FetchItem
+   var lastMap *Map
+   for _, segment := range mp.ResolvedSegments() {
+      if segment.Map != nil && segment.Map != lastMap {
+         item := FetchItem{Init: true}
+         item.URL = segment.Map.URI
+         if segment.Map.ByteRange != nil {
+            item.Range = segment.Map.ByteRange.RangeHeader()
+         }
+         plan = append(plan, item)
+      }
+      lastMap = segment.Map
+      item := FetchItem{
+         Key:            segment.Key,
+         Keys:           segment.Keys,
+         IV:             segment.IV,
+         Gap:            segment.Gap,
+         SequenceNumber: segment.SequenceNumber,
+      }
+      item.URL = segment.URI
+      if segment.ByteRange != nil {
+         item.Range = segment.ByteRange.RangeHeader()
+      }
+      plan = append(plan, item)
+   }
+   return plan
+}
+
+// VersionRequired returns the lowest EXT-X-VERSION that supports every
+// feature the playlist uses, following the protocol version compatibility
+// section of the spec.
+func (mp *MediaPlaylist) VersionRequired() int {
+   version := 1
+   for _, keyItem := range mp.Keys {
+      if keyItem.IV != "" {
+         version = max(version, 2)
+      }
+      if keyItem.KeyFormat != "" || keyItem.KeyFormatVersions != "" {
+         version = max(version, 5)
+      }
+   }
+   for _, segment := range mp.Segments {
+      if segment.Duration != math.Trunc(segment.Duration) {
+         version = max(version, 3)
+         break
+      }
+   }
+   for _, segment := range mp.Segments {
+      if segment.ByteRange != nil {
+         version = max(version, 4)
+         break
+      }
+   }
+   if mp.IFramesOnly {
+      version = max(version, 4)
+   }
+   if len(mp.Maps) > 0 {
+      // EXT-X-MAP was allowed in I-frame playlists a version earlier
+      if mp.IFramesOnly {
+         version = max(version, 5)
+      } else {
+         version = max(version, 6)
+      }
+   }
+   return version
+}
+
+// DuplicateURIs returns the indexes of segments that share a URI, one group
+// per URI in order of first appearance. Segments of the same resource with
+// different byte ranges are not duplicates. It returns nil if there are none.
+func (mp *MediaPlaylist) DuplicateURIs() [][]int {
+   groups := make(map[string][]int)
+   var order []string
+   for i, segment := range mp.Segments {
+      if segment.URI == nil {
+         continue
+      }
+      key := segment.URI.String()
+      if segment.ByteRange != nil {
+         key += " " + segment.ByteRange.RangeHeader()
+      }
+      if _, ok := groups[key]; !ok {
+         order = append(order, key)
+      }
+      groups[key] = append(groups[key], i)
+   }
+   var duplicates [][]int
+   for _, key := range order {
+      if len(groups[key]) > 1 {
+         duplicates = append(duplicates, groups[key])
+      }
+   }
+   return duplicates
+}
+
+// MaxSegmentDuration returns the longest segment duration, in seconds.
+func (mp *MediaPlaylist) MaxSegmentDuration() float64 {
+   var longest float64
+   for _, segment := range mp.Segments {
+      longest = max(longest, segment.Duration)
+   }
+   return longest
+}
+
+// DownloadableSegments returns the segments that can be fetched, leaving out
+// those marked Gap. Segments removed by #EXT-X-SKIP in a delta update are
+// never listed, so they need no filtering. Segments is not modified.
+func (mp *MediaPlaylist) DownloadableSegments() []*Segment {
+   return mp.NonGapSegments()
+}
+
+// NonGapSegments returns the segments not marked Gap. Gap segments still have
+// a duration and count towards StartTime and the playlist duration; they are
+// only left out of what can be fetched. Segments is not modified.
+func (mp *MediaPlaylist) NonGapSegments() []*Segment {
+   var segments []*Segment
+   for _, segment := range mp.Segments {
+      if !segment.Gap {
+         segments = append(segments, segment)
+      }
+   }
+   return segments
+}
+
 type Segment struct {
-   URI      *url.URL
-   Duration float64
-   Title    string
+   URI             *url.URL
+   Duration        float64
+   RawDuration     string // Duration as written, such as "6.006000"
+   Title           string
+   Map             *Map       // The initialization map that applies to this segment
+   Key             *Key       // The last key in scope, nil if the segment is not encrypted
+   Keys            []*Key     // The keys in scope, one per KEYFORMAT, such as one per DRM system
+   ProgramDateTime time.Time  // From #EXT-X-PROGRAM-DATE-TIME, zero if absent
+   Discontinuity   bool       // Preceded by #EXT-X-DISCONTINUITY
+   Gap             bool       // Marked #EXT-X-GAP, so it must not be loaded
+   ByteRange       *ByteRange // From #EXT-X-BYTERANGE, nil for the whole resource
+   Bitrate         int        // kbps from the last #EXT-X-BITRATE, 0 if absent
+   // StartTime is the sum of the preceding durations, in seconds. It is
+   // relative to the first segment listed, not to media sequence zero.
+   StartTime  float64
+   SourceLine int // Line of the #EXTINF tag
+}
+
+// ResolvedSegment is a segment with everything that applies to it gathered
+// in one place, for consumers that do not want to track playlist state.
+type ResolvedSegment struct {
+   URI             *url.URL
+   Duration        float64
+   SequenceNumber  int    // Media Sequence Number
+   Key             *Key   // The last key in scope
+   Keys            []*Key // The keys in scope, one per KEYFORMAT
+   IV              string // Key.IV, or for AES-128 the one implied by SequenceNumber
+   ByteRange       *ByteRange
+   Map             *Map
+   Discontinuity   bool
+   Gap             bool
+   ProgramDateTime time.Time
+}
+
+// ResolvedSegments returns a ResolvedSegment for each segment, in order. URIs
+// are as they are in the playlist, so call ResolveURIs first to get absolute
+// ones. When an AES-128 key has no IV, IV is the Media Sequence Number as a
+// 128-bit hexadecimal integer, as RFC 8216 specifies; other methods have no
+// implied IV. Key and Keys are nil for unencrypted segments.
+func (mp *MediaPlaylist) ResolvedSegments() []ResolvedSegment {
+   resolved := make([]ResolvedSegment, len(mp.Segments))
+   for i, segment := range mp.Segments {
+      sequence := mp.MediaSequence + i
+      item := ResolvedSegment{
+         URI:             segment.URI,
+         Duration:        segment.Duration,
+         SequenceNumber:  sequence,
+         ByteRange:       segment.ByteRange,
+         Map:             segment.Map,
+         Discontinuity:   segment.Discontinuity,
+         Gap:             segment.Gap,
+         ProgramDateTime: segment.ProgramDateTime,
+      }
+      if segment.Key != nil && segment.Key.Method != "NONE" {
+         item.Key = segment.Key
+         item.Keys = segment.Keys
+         item.IV = segment.Key.IV
+         if item.IV == "" && segment.Key.Method == "AES-128" {
+            item.IV = fmt.Sprintf("0x%032x", sequence)
+         }
+      }
+      resolved[i] = item
+   }
+   return resolved
+}
+
+// TimelineEntry is one segment's place on the playlist timeline.
+type TimelineEntry struct {
+   Start         float64 // seconds from the first segment listed
+   End           float64
+   URI           *url.URL
+   Discontinuity bool
+   Gap           bool
+   KeyChange     bool // the key in scope differs from the previous segment's
+}
+
+// Timeline returns a TimelineEntry for each segment, in order, for debugging
+// and for asserting timing in tests. Start and End follow Segment.StartTime.
+func (mp *MediaPlaylist) Timeline() []TimelineEntry {
+   timeline := make([]TimelineEntry, len(mp.Segments))
+   for i, segment := range mp.Segments {
+      timeline[i] = TimelineEntry{
+         Start:         segment.StartTime,
+         End:           segment.StartTime + segment.Duration,
+         URI:           segment.URI,
+         Discontinuity: segment.Discontinuity,
+         Gap:           segment.Gap,
+      }
+   }
+   for _, i := range mp.KeyRotationPoints() {
+      timeline[i].KeyChange = true
+   }
+   return timeline
+}
+
+// TitleAttributes parses a title in the form key=value or key1=val1;key2=val2.
+// Empty pairs, such as after a trailing ";", are ignored. It returns nil if
+// the title is plain text, including any with a key that contains whitespace
+// or ':', such as "Episode 1: a=b".
+func (s *Segment) TitleAttributes() map[string]string {
+   attributes := make(map[string]string)
+   for _, pair := range strings.Split(s.Title, ";") {
+      if strings.TrimSpace(pair) == "" {
+         continue
+      }
+      key, value, found := strings.Cut(pair, "=")
+      key = strings.TrimSpace(key)
+      if !found || key == "" || strings.ContainsAny(key, ": \t") {
+         return nil
+      }
+      attributes[key] = strings.TrimSpace(value)
+   }
+   if len(attributes) == 0 {
+      return nil
+   }
+   return attributes
+}
+
+// replaceKey returns a copy of keys with newKey in place of the key with the
+// same KEYFORMAT, or appended if there is none. Segments share the slices, so
+// keys itself is not modified.
+func replaceKey(keys []*Key, newKey *Key) []*Key {
+   replaced := make([]*Key, 0, len(keys)+1)
+   found := false
+   for _, keyItem := range keys {
+      if keyItem.keyFormat() == newKey.keyFormat() {
+         keyItem = newKey
+         found = true
+      }
+      replaced = append(replaced, keyItem)
+   }
+   if !found {
+      replaced = append(replaced, newKey)
+   }
+   return replaced
 }
 
 // resolve updates the Segment's URI to be absolute.
@@ -44,12 +912,83 @@ func (s *Segment) resolve(base *url.URL) {
    }
 }
 
-func parseMedia(lines []string) (*MediaPlaylist, error) {
-   mediaPlaylist := &MediaPlaylist{}
+func parseMedia(lines []string, numbers []int, opts *DecodeOptions) (*MediaPlaylist, error) {
+   // Without #EXT-X-VERSION a playlist is version 1
+   mediaPlaylist := &MediaPlaylist{Version: 1}
+   if opts.Stats != nil {
+      opts.Stats.LineCount += len(lines)
+   }
+   var currentMap *Map
+   var currentKey *Key
+   var currentKeys []*Key // one per KEYFORMAT
+   var programDateTime time.Time
+   var startTime float64
+   var header bool
+   var hasTargetDuration bool
+   var discontinuity bool
+   var gap bool
+   var byteRange *ByteRange
+   var byteRangeOffset bool
+   var bitrate int
+   rangeEnds := make(map[string]int64) // end of the last sub-range of each URI
 
+   // pending is the segment of the last EXTINF, until its URI is found
+   var pending *Segment
+   finish := func(uri *url.URL) {
+      segment := pending
+      pending = nil
+      segment.URI = uri
+      segment.Map = currentMap
+      segment.Key = currentKey
+      segment.Keys = currentKeys
+      segment.ProgramDateTime = programDateTime
+      segment.StartTime = startTime
+      segment.Discontinuity = discontinuity
+      segment.Gap = gap
+      // EXT-X-BITRATE does not apply to byte-range segments
+      if byteRange == nil {
+         segment.Bitrate = bitrate
+      }
+      discontinuity = false
+      gap = false
+      startTime += segment.Duration
+      programDateTime = time.Time{}
+      if byteRange != nil {
+         // Without an offset the range follows the previous sub-range of
+         // the same resource, which is only known once we have the URI
+         resource := uriString(uri)
+         if !byteRangeOffset {
+            byteRange.Offset = rangeEnds[resource]
+         }
+         rangeEnds[resource] = byteRange.Offset + byteRange.Length
+         segment.ByteRange = byteRange
+         byteRange = nil
+      }
+      mediaPlaylist.Segments = append(mediaPlaylist.Segments, segment)
+   }
+   // finishWithoutURI ends a segment whose EXTINF was followed by no URI line
+   // before the next EXTINF or the end. It still makes a segment, but a
+   // missing newline may have glued the URI onto the EXTINF line as its title.
+   finishWithoutURI := func() {
+      var uri *url.URL
+      if !opts.Strict && looksLikeURI(pending.Title) {
+         if parsedURL, err := opts.parse(pending.Title); err == nil {
+            pending.Title = ""
+            uri = parsedURL
+         }
+      }
+      finish(uri)
+   }
+
+lines:
    for i := 0; i < len(lines); i++ {
       line := lines[i]
       switch {
+      case line == "#EXTM3U":
+         if header && opts.Strict {
+            return nil, errors.New("unexpected second #EXTM3U")
+         }
+         header = true
       case strings.HasPrefix(line, "#EXT-X-VERSION:"):
          version, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-VERSION:"))
          if err != nil {
@@ -62,6 +1001,7 @@ func parseMedia(lines []string) (*MediaPlaylist, error) {
             return nil, fmt.Errorf("invalid EXT-X-TARGETDURATION: %w", err)
          }
          mediaPlaylist.TargetDuration = duration
+         hasTargetDuration = true
       case strings.HasPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"):
          sequence, err := strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-MEDIA-SEQUENCE:"))
          if err != nil {
@@ -70,16 +1010,108 @@ func parseMedia(lines []string) (*MediaPlaylist, error) {
          mediaPlaylist.MediaSequence = sequence
       case strings.HasPrefix(line, "#EXT-X-PLAYLIST-TYPE:"):
          mediaPlaylist.PlaylistType = strings.TrimPrefix(line, "#EXT-X-PLAYLIST-TYPE:")
+      case strings.HasPrefix(line, "#EXT-X-PART-INF:"):
+         attrs, err := parseAttributes(line, "#EXT-X-PART-INF:", opts.Strict)
+         if err != nil {
+            return nil, err
+         }
+         target, err := strconv.ParseFloat(attrs["PART-TARGET"], 64)
+         if err != nil {
+            if opts.Strict {
+               return nil, fmt.Errorf("invalid EXT-X-PART-INF: %w", err)
+            }
+            target = 0
+         }
+         mediaPlaylist.PartTarget = target
+      case strings.HasPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:"):
+         value := strings.TrimPrefix(line, "#EXT-X-PROGRAM-DATE-TIME:")
+         parsedTime, err := time.Parse(time.RFC3339Nano, value)
+         if err != nil && opts.Strict {
+            return nil, fmt.Errorf("invalid EXT-X-PROGRAM-DATE-TIME: %w", err)
+         }
+         programDateTime = parsedTime
+      case strings.HasPrefix(line, "#EXT-X-DATERANGE:"):
+         dateRange, err := parseDateRange(line, opts.Strict)
+         if err != nil {
+            return nil, err
+         }
+         dateRange.SourceLine = numbers[i]
+         mediaPlaylist.DateRanges = append(mediaPlaylist.DateRanges, dateRange)
+      case line == "#EXT-X-INDEPENDENT-SEGMENTS":
+         mediaPlaylist.IndependentSegments = true
+      case line == "#EXT-X-I-FRAMES-ONLY":
+         mediaPlaylist.IFramesOnly = true
+      case strings.HasPrefix(line, "#EXT-X-START:"):
+         start, err := parseStart(line, opts.Strict)
+         if err != nil {
+            return nil, err
+         }
+         mediaPlaylist.Start = start
+      case line == "#EXT-X-DISCONTINUITY":
+         discontinuity = true
+      case line == "#EXT-X-GAP":
+         gap = true
+      case strings.HasPrefix(line, "#EXT-X-BITRATE:"):
+         var err error
+         bitrate, err = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-BITRATE:"))
+         if err != nil {
+            return nil, fmt.Errorf("invalid EXT-X-BITRATE: %w", err)
+         }
+      case strings.HasPrefix(line, "#EXT-X-BYTERANGE:"):
+         var err error
+         byteRange, byteRangeOffset, err = parseByteRange(strings.TrimPrefix(line, "#EXT-X-BYTERANGE:"))
+         if err != nil {
+            return nil, fmt.Errorf("invalid EXT-X-BYTERANGE: %w", err)
+         }
       case strings.HasPrefix(line, "#EXT-X-ENDLIST"):
          mediaPlaylist.EndList = true
+         // Nothing may follow ENDLIST, so stray trailing lines are ignored
+         if i+1 < len(lines) {
+            if opts.Strict {
+               return nil, fmt.Errorf("line %d: content after EXT-X-ENDLIST", numbers[i+1])
+            }
+            if opts.Stats != nil {
+               opts.Stats.SkippedLines += len(lines) - (i + 1)
+            }
+            break lines
+         }
       case strings.HasPrefix(line, "#EXT-X-KEY:"):
-         newKey := parseKey(line)
+         newKey, err := parseKey(line, "#EXT-X-KEY:", opts)
+         if err != nil {
+            return nil, err
+         }
+         newKey.SourceLine = numbers[i]
          mediaPlaylist.Keys = append(mediaPlaylist.Keys, newKey)
+         // METHOD=NONE ends encryption for the segments that follow. Keys
+         // with different KEYFORMATs, such as one per DRM system, all apply
+         // at once, and a new key replaces the one with its KEYFORMAT.
+         if newKey.Method == "NONE" {
+            currentKey = nil
+            currentKeys = nil
+         } else {
+            currentKey = newKey
+            currentKeys = replaceKey(currentKeys, newKey)
+         }
       case strings.HasPrefix(line, "#EXT-X-MAP:"):
-         attrs := parseAttributes(line, "#EXT-X-MAP:")
+         attrs, err := parseAttributes(line, "#EXT-X-MAP:", opts.Strict)
+         if err != nil {
+            return nil, err
+         }
          if value, ok := attrs["URI"]; ok && value != "" {
-            if parsedURL, err := url.Parse(value); err == nil {
+            var byteRange *ByteRange
+            if rangeValue, ok := attrs["BYTERANGE"]; ok {
+               byteRange, _, err = parseByteRange(rangeValue)
+               if err != nil {
+                  return nil, fmt.Errorf("invalid EXT-X-MAP BYTERANGE: %w", err)
+               }
+            }
+            parsedURL, err := opts.parseURI(value)
+            if err != nil {
+               return nil, err
+            }
+            if parsedURL != nil {
                mediaPlaylist.Map = parsedURL
+               currentMap = mediaPlaylist.findMap(parsedURL, byteRange)
             }
          }
       case strings.HasPrefix(line, "#EXTINF:"):
@@ -87,26 +1119,95 @@ func parseMedia(lines []string) (*MediaPlaylist, error) {
          // Format: #EXTINF:duration,[title]
          raw := strings.TrimPrefix(line, "#EXTINF:")
          durationStr, title, _ := strings.Cut(raw, ",")
+         // Legacy playlists may omit the comma or pad the duration
+         durationStr = strings.TrimSpace(durationStr)
          duration, err := strconv.ParseFloat(durationStr, 64)
          if err != nil {
             return nil, fmt.Errorf("invalid EXTINF duration: %w", err)
          }
-         newSegment := &Segment{
-            Duration: duration,
-            Title:    strings.TrimSpace(title),
+         if pending != nil {
+            finishWithoutURI()
          }
-         // The URI is on the next line
-         if i+1 < len(lines) {
-            nextLine := lines[i+1]
-            if !strings.HasPrefix(nextLine, "#") && nextLine != "" {
-               if parsedURL, err := url.Parse(nextLine); err == nil {
-                  newSegment.URI = parsedURL
-               }
-               i++
-            }
+         pending = &Segment{
+            Duration:    duration,
+            RawDuration: durationStr,
+            Title:       strings.TrimSpace(title),
+            SourceLine:  numbers[i],
+         }
+      case pending != nil && !strings.HasPrefix(line, "#"):
+         // Tags such as EXT-X-BYTERANGE may come between EXTINF and the URI
+         parsedURL, err := opts.parseURI(line)
+         if err != nil {
+            return nil, fmt.Errorf("line %d: %w", numbers[i], err)
+         }
+         finish(parsedURL)
+      default:
+         handled, err := opts.handleMedia(line, mediaPlaylist)
+         if err != nil {
+            return nil, err
          }
-         mediaPlaylist.Segments = append(mediaPlaylist.Segments, newSegment)
+         if !handled {
+            opts.unrecognized(line, numbers[i])
+         }
+      }
+   }
+   if pending != nil {
+      finishWithoutURI()
+   }
+   linkDateRanges(mediaPlaylist.DateRanges)
+   if opts.Stats != nil {
+      opts.Stats.SegmentCount += len(mediaPlaylist.Segments)
+   }
+   if !hasTargetDuration {
+      if opts.Strict {
+         return nil, errors.New("missing EXT-X-TARGETDURATION")
       }
+      // Reload timing is based on the target duration, so 0 is not an option
+      mediaPlaylist.TargetDuration = int(math.Ceil(mediaPlaylist.MaxSegmentDuration()))
+      mediaPlaylist.TargetDurationEstimated = true
+   }
+   if opts.Strict && mediaPlaylist.Version < mediaPlaylist.VersionRequired() {
+      return nil, fmt.Errorf(
+         "EXT-X-VERSION %d is lower than the %d required by the tags used",
+         mediaPlaylist.Version, mediaPlaylist.VersionRequired(),
+      )
    }
    return mediaPlaylist, nil
 }
+
+// findMap returns the map with the given URI and byte range, adding it to
+// Maps if it is new.
+func (mp *MediaPlaylist) findMap(uri *url.URL, byteRange *ByteRange) *Map {
+   for _, mapItem := range mp.Maps {
+      if mapItem.URI.String() != uri.String() {
+         continue
+      }
+      if sameByteRange(mapItem.ByteRange, byteRange) {
+         return mapItem
+      }
+   }
+   newMap := &Map{URI: uri, ByteRange: byteRange}
+   mp.Maps = append(mp.Maps, newMap)
+   return newMap
+}
+
+// segmentExtensions are file extensions that mark a string as a segment URI.
+var segmentExtensions = map[string]bool{
+   ".aac": true, ".ac3": true, ".cmfa": true, ".cmfv": true, ".ec3": true,
+   ".m4a": true, ".m4s": true, ".m4v": true, ".mp3": true, ".mp4": true,
+   ".ts": true, ".vtt": true, ".webvtt": true,
+}
+
+// looksLikeURI reports whether an EXTINF title is more likely a segment URI
+// than a title: it has no spaces, and it contains a slash or ends in a known
+// segment extension.
+func looksLikeURI(title string) bool {
+   if title == "" || strings.ContainsAny(title, " \t") {
+      return false
+   }
+   if strings.Contains(title, "/") {
+      return true
+   }
+   name, _, _ := strings.Cut(title, "?")
+   return segmentExtensions[strings.ToLower(path.Ext(name))]
+}
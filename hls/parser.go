@@ -1,30 +1,419 @@
 package hls
 
 import (
+   "bufio"
+   "bytes"
+   "errors"
+   "fmt"
+   "io"
+   "net/url"
+   "strconv"
    "strings"
 )
 
+// Playlist is either a *MasterPlaylist or a *MediaPlaylist.
+type Playlist interface {
+   ResolveURIs(base *url.URL)
+}
+
+// DecodeOptions controls how playlists are decoded. The zero value is
+// lenient and is what DecodeMaster and DecodeMedia use.
+type DecodeOptions struct {
+   // Strict reports malformed input as an error instead of recovering from it.
+   Strict bool
+   // OnUnrecognized, if set, is called with each line the parser ignored,
+   // along with its 1-based line number: unknown or misspelled #EXT tags and
+   // stray lines that are not a URI of any tag. Comments are not reported.
+   OnUnrecognized func(line string, num int)
+   // URIParser, if set, parses every URI in place of url.Parse, so callers
+   // can escape or leniently parse URIs that url.Parse rejects, such as ones
+   // with unescaped spaces or braces. A URI that fails to parse is left nil,
+   // or is an error in strict mode.
+   URIParser func(string) (*url.URL, error)
+   // Stats, if set, is overwritten with counts from each decode. Decodes
+   // that run at the same time must not share it.
+   Stats *ParseStats
+
+   mediaHandlers  []mediaTagHandler
+   masterHandlers []masterTagHandler
+}
+
+// ParseStats describes what a decode read, for monitoring packager output.
+type ParseStats struct {
+   BytesRead    int
+   LineCount    int // lines that were not blank
+   SegmentCount int // Media Playlist segments
+   SkippedLines int // comments and stray lines that belong to no tag
+   UnknownTags  int // #EXT tags the parser and tag handlers do not handle
+}
+
+type mediaTagHandler struct {
+   prefix string
+   fn     func(attrs map[string]string, mp *MediaPlaylist)
+}
+
+type masterTagHandler struct {
+   prefix string
+   fn     func(attrs map[string]string, mp *MasterPlaylist)
+}
+
+// RegisterTagHandler calls fn for each Media Playlist line that starts with
+// prefix, such as "#EXT-X-VENDOR-CUE:", passing the attribute list after the
+// prefix. Handlers only see tags the parser does not handle itself, and the
+// first matching handler in registration order wins. Handled lines are not
+// reported to OnUnrecognized.
+//
+// Handlers must be registered before decoding starts. Registering is not
+// safe for concurrent use, but decoding with the same options from several
+// goroutines is, as long as the handlers themselves are.
+func (o *DecodeOptions) RegisterTagHandler(
+   prefix string, fn func(attrs map[string]string, mp *MediaPlaylist),
+) {
+   o.mediaHandlers = append(o.mediaHandlers, mediaTagHandler{prefix, fn})
+}
+
+// RegisterMasterTagHandler is RegisterTagHandler for Master Playlists.
+func (o *DecodeOptions) RegisterMasterTagHandler(
+   prefix string, fn func(attrs map[string]string, mp *MasterPlaylist),
+) {
+   o.masterHandlers = append(o.masterHandlers, masterTagHandler{prefix, fn})
+}
+
+// handleMedia passes line to the first matching handler and reports whether
+// there was one.
+func (o *DecodeOptions) handleMedia(line string, mp *MediaPlaylist) (bool, error) {
+   for _, handler := range o.mediaHandlers {
+      if strings.HasPrefix(line, handler.prefix) {
+         attrs, err := parseAttributes(line, handler.prefix, o.Strict)
+         if err != nil {
+            return false, err
+         }
+         handler.fn(attrs, mp)
+         return true, nil
+      }
+   }
+   return false, nil
+}
+
+// handleMaster is handleMedia for Master Playlists.
+func (o *DecodeOptions) handleMaster(line string, mp *MasterPlaylist) (bool, error) {
+   for _, handler := range o.masterHandlers {
+      if strings.HasPrefix(line, handler.prefix) {
+         attrs, err := parseAttributes(line, handler.prefix, o.Strict)
+         if err != nil {
+            return false, err
+         }
+         handler.fn(attrs, mp)
+         return true, nil
+      }
+   }
+   return false, nil
+}
+
+// parse parses value with URIParser, or url.Parse if it is nil.
+func (o *DecodeOptions) parse(value string) (*url.URL, error) {
+   if o.URIParser != nil {
+      return o.URIParser(value)
+   }
+   return url.Parse(value)
+}
+
+// parseURI is parse, except that a failure is only an error in strict mode.
+// Otherwise the URI is nil.
+func (o *DecodeOptions) parseURI(value string) (*url.URL, error) {
+   parsedURL, err := o.parse(value)
+   if err != nil {
+      if o.Strict {
+         return nil, fmt.Errorf("invalid URI %q: %w", value, err)
+      }
+      return nil, nil
+   }
+   return parsedURL, nil
+}
+
+func (o *DecodeOptions) unrecognized(line string, num int) {
+   comment := strings.HasPrefix(line, "#") && !strings.HasPrefix(line, "#EXT")
+   if o.Stats != nil {
+      if strings.HasPrefix(line, "#EXT") {
+         o.Stats.UnknownTags++
+      } else {
+         o.Stats.SkippedLines++
+      }
+   }
+   if o.OnUnrecognized == nil || comment {
+      return
+   }
+   o.OnUnrecognized(line, num)
+}
+
+// startStats resets Stats, if set, for a decode of size bytes.
+func (o *DecodeOptions) startStats(size int) {
+   if o.Stats != nil {
+      *o.Stats = ParseStats{BytesRead: size}
+   }
+}
+
+// DecodeMaster parses a Master Playlist.
+func (o *DecodeOptions) DecodeMaster(content string) (*MasterPlaylist, error) {
+   o.startStats(len(content))
+   lines, numbers := splitLines(content)
+   return parseMaster(lines, numbers, o)
+}
+
+// DecodeMedia parses a Media Playlist.
+func (o *DecodeOptions) DecodeMedia(content string) (*MediaPlaylist, error) {
+   o.startStats(len(content))
+   lines, numbers := splitLines(content)
+   return parseMedia(lines, numbers, o)
+}
+
+// DecodeMasterBytes parses a Master Playlist without first converting the
+// whole input to a string.
+func (o *DecodeOptions) DecodeMasterBytes(content []byte) (*MasterPlaylist, error) {
+   o.startStats(len(content))
+   lines, numbers := splitLinesBytes(content)
+   return parseMaster(lines, numbers, o)
+}
+
+// DecodeMediaBytes parses a Media Playlist without first converting the
+// whole input to a string.
+func (o *DecodeOptions) DecodeMediaBytes(content []byte) (*MediaPlaylist, error) {
+   o.startStats(len(content))
+   lines, numbers := splitLinesBytes(content)
+   return parseMedia(lines, numbers, o)
+}
+
+// DecodeMediaMulti parses a stream of concatenated Media Playlists. A new
+// playlist starts at every #EXTM3U line; lines before the first #EXTM3U
+// belong to the first playlist.
+func (o *DecodeOptions) DecodeMediaMulti(r io.Reader) ([]*MediaPlaylist, error) {
+   data, err := io.ReadAll(r)
+   if err != nil {
+      return nil, err
+   }
+   o.startStats(len(data))
+   var playlists []*MediaPlaylist
+   lines, numbers := splitLinesBytes(data)
+   for len(lines) > 0 {
+      end := 1
+      for end < len(lines) && lines[end] != "#EXTM3U" {
+         end++
+      }
+      playlist, err := parseMedia(lines[:end], numbers[:end], o)
+      if err != nil {
+         return nil, err
+      }
+      playlists = append(playlists, playlist)
+      lines, numbers = lines[end:], numbers[end:]
+   }
+   return playlists, nil
+}
+
 // DecodeMaster parses a Master Playlist.
 func DecodeMaster(content string) (*MasterPlaylist, error) {
-   lines := splitLines(content)
-   return parseMaster(lines)
+   return (&DecodeOptions{}).DecodeMaster(content)
 }
 
 // DecodeMedia parses a Media Playlist.
 func DecodeMedia(content string) (*MediaPlaylist, error) {
-   lines := splitLines(content)
-   return parseMedia(lines)
+   return (&DecodeOptions{}).DecodeMedia(content)
+}
+
+// DecodeMasterBytes parses a Master Playlist without first converting the
+// whole input to a string.
+func DecodeMasterBytes(content []byte) (*MasterPlaylist, error) {
+   return (&DecodeOptions{}).DecodeMasterBytes(content)
+}
+
+// DecodeMediaBytes parses a Media Playlist without first converting the
+// whole input to a string.
+func DecodeMediaBytes(content []byte) (*MediaPlaylist, error) {
+   return (&DecodeOptions{}).DecodeMediaBytes(content)
+}
+
+// DecodeMediaMulti parses a stream of concatenated Media Playlists.
+func DecodeMediaMulti(r io.Reader) ([]*MediaPlaylist, error) {
+   return (&DecodeOptions{}).DecodeMediaMulti(r)
+}
+
+// DecodeDataURI parses a Master or Media Playlist embedded in a base64 data
+// URI, such as "data:application/vnd.apple.mpegurl;base64,I0VYVE0zVQ==". The
+// media type must be an HLS playlist type or text; a missing one means
+// text/plain.
+func DecodeDataURI(dataURI string) (Playlist, error) {
+   u, err := url.Parse(dataURI)
+   if err != nil {
+      return nil, err
+   }
+   mediaType, data, err := decodeDataURI(u)
+   if err != nil {
+      return nil, err
+   }
+   switch {
+   case mediaType == "",
+      mediaType == "application/vnd.apple.mpegurl",
+      mediaType == "application/x-mpegurl",
+      mediaType == "audio/mpegurl",
+      strings.HasPrefix(mediaType, "text/"):
+   default:
+      return nil, fmt.Errorf("data URI media type %q is not a playlist", mediaType)
+   }
+   lines, numbers := splitLinesBytes(data)
+   return decodePlaylist(lines, numbers, &DecodeOptions{})
+}
+
+// PlaylistKind is the type of a playlist, as reported by DetectType.
+type PlaylistKind int
+
+const (
+   KindMedia PlaylistKind = iota
+   KindMaster
+)
+
+// DetectType reads only as far as needed to tell a Master Playlist from a
+// Media Playlist, classifying it the same way decoding does, and returns
+// the kind along with the EXT-X-VERSION declared before that point, or 1.
+// It builds no streams or segments, so routing a large VOD playlist costs a
+// few lines instead of a full parse.
+func DetectType(r io.Reader) (PlaylistKind, int, error) {
+   reader := bufio.NewReader(r)
+   version := 1
+   for {
+      raw, err := reader.ReadString('\n')
+      if err != nil && !errors.Is(err, io.EOF) {
+         return 0, 0, err
+      }
+      // A chunk holds several lines if they end with a lone "\r"
+      for rest := raw; len(rest) > 0; {
+         var line string
+         line, rest = cutLine(rest)
+         line = strings.TrimSpace(line)
+         switch {
+         case strings.HasPrefix(line, "#EXT-X-VERSION:"):
+            var parseErr error
+            version, parseErr = strconv.Atoi(strings.TrimPrefix(line, "#EXT-X-VERSION:"))
+            if parseErr != nil {
+               return 0, 0, fmt.Errorf("invalid EXT-X-VERSION: %w", parseErr)
+            }
+         case isMasterTag(line):
+            return KindMaster, version, nil
+         case strings.HasPrefix(line, "#EXTINF:"):
+            return KindMedia, version, nil
+         }
+      }
+      if errors.Is(err, io.EOF) {
+         return KindMedia, version, nil
+      }
+   }
+}
+
+// decodePlaylist parses lines as a Master Playlist if a master-only tag
+// appears before the first #EXTINF, otherwise as a Media Playlist.
+func decodePlaylist(lines []string, numbers []int, opts *DecodeOptions) (Playlist, error) {
+   if isMaster(lines) {
+      master, err := parseMaster(lines, numbers, opts)
+      if err != nil {
+         return nil, err
+      }
+      return master, nil
+   }
+   media, err := parseMedia(lines, numbers, opts)
+   if err != nil {
+      return nil, err
+   }
+   return media, nil
 }
 
-// Helper to split and trim lines
-func splitLines(content string) []string {
-   rawLines := strings.Split(content, "\n")
-   lines := make([]string, 0, len(rawLines))
-   for _, raw := range rawLines {
-      line := strings.TrimSpace(raw)
-      if line != "" {
+func isMaster(lines []string) bool {
+   for _, line := range lines {
+      switch {
+      case isMasterTag(line):
+         return true
+      case strings.HasPrefix(line, "#EXTINF:"):
+         return false
+      }
+   }
+   return false
+}
+
+// isMasterTag reports whether line is a tag only Master Playlists have.
+func isMasterTag(line string) bool {
+   return strings.HasPrefix(line, "#EXT-X-STREAM-INF:") ||
+      strings.HasPrefix(line, "#EXT-X-I-FRAME-STREAM-INF:") ||
+      strings.HasPrefix(line, "#EXT-X-MEDIA:")
+}
+
+// Helper to split and trim lines. It also returns the 1-based source line
+// number of each line kept. Lines end with "\n", "\r\n" or a lone "\r", as
+// in files from classic Mac OS.
+func splitLines(content string) ([]string, []int) {
+   var lines []string
+   var numbers []int
+   for number, rest := 1, content; len(rest) > 0; number++ {
+      var raw string
+      raw, rest = cutLine(rest)
+      if line := strings.TrimSpace(raw); line != "" {
          lines = append(lines, line)
+         numbers = append(numbers, number)
+      }
+   }
+   return lines, numbers
+}
+
+// cutLine slices content around the first line ending, "\r\n", "\n" or "\r".
+func cutLine(content string) (line, rest string) {
+   i := strings.IndexAny(content, "\r\n")
+   if i < 0 {
+      return content, ""
+   }
+   if content[i] == '\r' && i+1 < len(content) && content[i+1] == '\n' {
+      return content[:i], content[i+2:]
+   }
+   return content[:i], content[i+1:]
+}
+
+// cutLineBytes is cutLine over a byte slice.
+func cutLineBytes(content []byte) (line, rest []byte) {
+   i := bytes.IndexAny(content, "\r\n")
+   if i < 0 {
+      return content, nil
+   }
+   if content[i] == '\r' && i+1 < len(content) && content[i+1] == '\n' {
+      return content[:i], content[i+2:]
+   }
+   return content[:i], content[i+1:]
+}
+
+// splitLinesBytes is splitLines over a byte slice. Only the trimmed lines are
+// copied, into a single string that the returned lines share.
+func splitLinesBytes(content []byte) ([]string, []int) {
+   var count, size int
+   for rest := content; len(rest) > 0; {
+      var raw []byte
+      raw, rest = cutLineBytes(rest)
+      if line := bytes.TrimSpace(raw); len(line) > 0 {
+         count++
+         size += len(line)
+      }
+   }
+   var builder strings.Builder
+   builder.Grow(size)
+   for rest := content; len(rest) > 0; {
+      var raw []byte
+      raw, rest = cutLineBytes(rest)
+      builder.Write(bytes.TrimSpace(raw))
+   }
+   joined := builder.String()
+   lines := make([]string, 0, count)
+   numbers := make([]int, 0, count)
+   for number, rest := 1, content; len(rest) > 0; number++ {
+      var raw []byte
+      raw, rest = cutLineBytes(rest)
+      if n := len(bytes.TrimSpace(raw)); n > 0 {
+         lines = append(lines, joined[:n])
+         numbers = append(numbers, number)
+         joined = joined[n:]
       }
    }
-   return lines
+   return lines, numbers
 }
@@ -0,0 +1,115 @@
+package hls
+
+import (
+   "errors"
+   "fmt"
+)
+
+// MergePathways combines the Master Playlists of several content steering
+// pathways into one. Streams and medias from every master are kept, each with
+// its own URI, and exact repeats of an earlier item are dropped. Items that
+// share a STABLE-VARIANT-ID or STABLE-RENDITION-ID are the same content on
+// different pathways, so MergePathways returns an error if their attributes
+// differ. Version is the highest of the masters; the other playlist level
+// fields come from the first master. The masters are not modified.
+func MergePathways(masters ...*MasterPlaylist) (*MasterPlaylist, error) {
+   if len(masters) == 0 {
+      return nil, errors.New("no playlists to merge")
+   }
+   first := masters[0]
+   merged := &MasterPlaylist{
+      Version:             first.Version,
+      IndependentSegments: first.IndependentSegments,
+   }
+   if first.Start != nil {
+      start := *first.Start
+      merged.Start = &start
+   }
+   for _, data := range first.SessionData {
+      copied := *data
+      merged.SessionData = append(merged.SessionData, &copied)
+   }
+   for _, keyItem := range first.SessionKeys {
+      copied := *keyItem
+      merged.SessionKeys = append(merged.SessionKeys, &copied)
+   }
+   variants := make(map[string]*StreamInf)
+   renditions := make(map[string]*Media)
+   seenStreams := make(map[string]bool)
+   seenFrames := make(map[string]bool)
+   seenMedias := make(map[string]bool)
+   for _, master := range masters {
+      merged.Version = max(merged.Version, master.Version)
+      for _, stream := range master.StreamInfs {
+         if id := stream.StableVariantID; id != "" {
+            if other, ok := variants[id]; ok && !sameVariant(stream, other) {
+               return nil, fmt.Errorf("STABLE-VARIANT-ID %q has differing attributes", id)
+            }
+            variants[id] = stream
+         }
+         key := stream.PathwayID + " " + uriString(stream.URI)
+         if seenStreams[key] {
+            continue
+         }
+         seenStreams[key] = true
+         merged.StreamInfs = append(merged.StreamInfs, stream.clone())
+      }
+      for _, stream := range master.IFrameStreams {
+         key := stream.PathwayID + " " + uriString(stream.URI)
+         if seenFrames[key] {
+            continue
+         }
+         seenFrames[key] = true
+         merged.IFrameStreams = append(merged.IFrameStreams, stream.clone())
+      }
+      for _, media := range master.Medias {
+         if id := media.StableRenditionID; id != "" {
+            if other, ok := renditions[id]; ok && !sameRendition(media, other) {
+               return nil, fmt.Errorf("STABLE-RENDITION-ID %q has differing attributes", id)
+            }
+            renditions[id] = media
+         }
+         key := media.Type + " " + media.GroupID + " " + media.Name + " " + uriString(media.URI)
+         if seenMedias[key] {
+            continue
+         }
+         seenMedias[key] = true
+         copied := *media
+         merged.Medias = append(merged.Medias, &copied)
+      }
+   }
+   merged.assignIDs()
+   return merged, nil
+}
+
+// clone returns a copy of the StreamInf that shares no slices with it.
+func (s *StreamInf) clone() *StreamInf {
+   copied := *s
+   copied.Audio = append([]string(nil), s.Audio...)
+   return &copied
+}
+
+// sameVariant reports whether two streams describe the same content, ignoring
+// their URI, pathway and the groups they refer to, which may differ between
+// pathways.
+func sameVariant(a, b *StreamInf) bool {
+   return a.Bandwidth == b.Bandwidth &&
+      a.AverageBandwidth == b.AverageBandwidth &&
+      a.Codecs == b.Codecs &&
+      a.SupplementalCodecs == b.SupplementalCodecs &&
+      a.Resolution == b.Resolution &&
+      a.FrameRate == b.FrameRate &&
+      a.VideoLayout == b.VideoLayout
+}
+
+// sameRendition reports whether two medias describe the same content,
+// ignoring their URI and group, which may differ between pathways.
+func sameRendition(a, b *Media) bool {
+   return a.Type == b.Type &&
+      a.Name == b.Name &&
+      a.Language == b.Language &&
+      a.AssocLanguage == b.AssocLanguage &&
+      a.Channels == b.Channels &&
+      a.Characteristics == b.Characteristics &&
+      a.InstreamID == b.InstreamID
+}
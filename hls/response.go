@@ -0,0 +1,31 @@
+package hls
+
+import (
+   "errors"
+   "io"
+   "net/http"
+)
+
+// DecodeFromResponse reads and closes the response body, parses it as a
+// Master or Media Playlist, and resolves its URIs against the final request
+// URL, so redirects are taken into account.
+func DecodeFromResponse(resp *http.Response) (Playlist, error) {
+   defer resp.Body.Close()
+   if resp.StatusCode < 200 || resp.StatusCode > 299 {
+      return nil, errors.New(resp.Status)
+   }
+   if resp.Request == nil || resp.Request.URL == nil {
+      return nil, errors.New("response has no request URL")
+   }
+   data, err := io.ReadAll(resp.Body)
+   if err != nil {
+      return nil, err
+   }
+   lines, numbers := splitLinesBytes(data)
+   playlist, err := decodePlaylist(lines, numbers, &DecodeOptions{})
+   if err != nil {
+      return nil, err
+   }
+   playlist.ResolveURIs(resp.Request.URL)
+   return playlist, nil
+}
@@ -0,0 +1,53 @@
+package hls
+
+import (
+   "fmt"
+   "net/url"
+)
+
+// SessionData represents an #EXT-X-SESSION-DATA tag. It carries either a
+// VALUE or a URI, never both.
+type SessionData struct {
+   DataID     string
+   Value      string
+   URI        *url.URL
+   Language   string
+   SourceLine int // Line of the #EXT-X-SESSION-DATA tag
+}
+
+// HasURI reports whether the data is carried by URI rather than VALUE.
+func (d *SessionData) HasURI() bool {
+   return d.URI != nil
+}
+
+func (d *SessionData) resolve(base *url.URL) {
+   if d.URI != nil {
+      d.URI = base.ResolveReference(d.URI)
+   }
+}
+
+func parseSessionData(line string, opts *DecodeOptions) (*SessionData, error) {
+   attrs, err := parseAttributes(line, "#EXT-X-SESSION-DATA:", opts.Strict)
+   if err != nil {
+      return nil, err
+   }
+   data := &SessionData{
+      DataID:   attrs["DATA-ID"],
+      Value:    attrs["VALUE"],
+      Language: attrs["LANGUAGE"],
+   }
+   value, hasValue := attrs["VALUE"]
+   uri, hasURI := attrs["URI"]
+   if opts.Strict && hasValue == hasURI {
+      return nil, fmt.Errorf(
+         "EXT-X-SESSION-DATA %q must have exactly one of VALUE or URI", data.DataID,
+      )
+   }
+   if hasURI && uri != "" && (!hasValue || value == "") {
+      data.URI, err = opts.parseURI(uri)
+      if err != nil {
+         return nil, err
+      }
+   }
+   return data, nil
+}
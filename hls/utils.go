@@ -1,19 +1,36 @@
 package hls
 
 import (
+   "fmt"
    "strings"
 )
 
 // parseAttributes parses HLS attribute lists (e.g., KEY="VAL",KEY2=VAL).
 // It handles quoted strings containing commas.
-func parseAttributes(line string, tagPrefix string) map[string]string {
+// Keys are upper-cased, so non-conformant lowercase names still resolve.
+// If a key is repeated, the first occurrence is kept, which is how most
+// players behave. In strict mode a repeated key is an error.
+func parseAttributes(line string, tagPrefix string, strict bool) (map[string]string, error) {
    line = strings.TrimPrefix(line, tagPrefix)
    attributes := make(map[string]string)
+   var duplicate string
 
    var keyBuilder, valueBuilder strings.Builder
    inKey := true
    inQuote := false
 
+   // addPair stores a pair unless the key was already seen
+   addPair := func() {
+      keyString := strings.ToUpper(strings.TrimSpace(keyBuilder.String()))
+      if _, ok := attributes[keyString]; ok {
+         if duplicate == "" {
+            duplicate = keyString
+         }
+         return
+      }
+      attributes[keyString] = valueBuilder.String()
+   }
+
    for i := 0; i < len(line); i++ {
       char := line[i]
 
@@ -32,9 +49,7 @@ func parseAttributes(line string, tagPrefix string) map[string]string {
 
          // If we hit a comma and we are NOT in a quote, it's the end of the pair
          if char == ',' && !inQuote {
-            keyString := strings.TrimSpace(keyBuilder.String())
-            valueString := valueBuilder.String()
-            attributes[keyString] = valueString
+            addPair()
 
             // Reset
             keyBuilder.Reset()
@@ -48,10 +63,28 @@ func parseAttributes(line string, tagPrefix string) map[string]string {
 
    // Flush the final pair
    if keyBuilder.Len() > 0 {
-      keyString := strings.TrimSpace(keyBuilder.String())
-      valueString := valueBuilder.String()
-      attributes[keyString] = valueString
+      addPair()
+   }
+
+   if strict && duplicate != "" {
+      return nil, fmt.Errorf(
+         "duplicate %s attribute in %s", duplicate, strings.Trim(tagPrefix, "#:"),
+      )
    }
+   return attributes, nil
+}
 
-   return attributes
+// splitCodecs splits a CODECS style attribute, or any other comma-separated
+// list such as CHARACTERISTICS, into its trimmed entries.
+func splitCodecs(codecs string) []string {
+   if codecs == "" {
+      return nil
+   }
+   var entries []string
+   for _, entry := range strings.Split(codecs, ",") {
+      if entry = strings.TrimSpace(entry); entry != "" {
+         entries = append(entries, entry)
+      }
+   }
+   return entries
 }
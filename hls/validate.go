@@ -0,0 +1,91 @@
+package hls
+
+import (
+   "errors"
+   "fmt"
+   "math"
+)
+
+// Validate checks the playlist against rules of the HLS spec that parsing
+// does not enforce. It returns every problem found, joined with errors.Join,
+// or nil.
+func (mp *MediaPlaylist) Validate() error {
+   var errs []error
+   for i, segment := range mp.Segments {
+      if int(math.Round(segment.Duration)) > mp.TargetDuration {
+         errs = append(errs, fmt.Errorf(
+            "segment %d (line %d): duration %g exceeds EXT-X-TARGETDURATION %d",
+            i, segment.SourceLine, segment.Duration, mp.TargetDuration,
+         ))
+      }
+   }
+   if i := mp.firstNonMonotonic(); i >= 0 {
+      errs = append(errs, fmt.Errorf(
+         "segment %d (line %d): negative duration or EXT-X-PROGRAM-DATE-TIME going backwards",
+         i, mp.Segments[i].SourceLine,
+      ))
+   }
+   for _, group := range mp.DuplicateURIs() {
+      first := mp.Segments[group[0]]
+      errs = append(errs, fmt.Errorf(
+         "segments %v (line %d): duplicate URI %s", group, first.SourceLine, first.URI,
+      ))
+   }
+   return errors.Join(errs...)
+}
+
+// Validate checks the playlist against rules of the HLS spec that parsing
+// does not enforce. It returns every problem found, joined with errors.Join,
+// or nil.
+func (mp *MasterPlaylist) Validate() error {
+   var errs []error
+   defaults := make(map[string]int)
+   for _, media := range mp.Medias {
+      if !media.Default {
+         continue
+      }
+      if !media.AutoSelect {
+         errs = append(errs, fmt.Errorf(
+            "EXT-X-MEDIA %q in group %q (line %d): DEFAULT=YES requires AUTOSELECT=YES",
+            media.Name, media.GroupID, media.SourceLine,
+         ))
+      }
+      key := media.Type + "/" + media.GroupID
+      defaults[key]++
+      if defaults[key] == 2 {
+         errs = append(errs, fmt.Errorf(
+            "%s group %q has more than one DEFAULT=YES rendition",
+            media.Type, media.GroupID,
+         ))
+      }
+   }
+   // Captions are carried in the video, so they are found by INSTREAM-ID
+   captionGroups := make(map[string]bool)
+   for _, media := range mp.Medias {
+      if media.MediaType() != MediaTypeClosedCaptions {
+         continue
+      }
+      captionGroups[media.GroupID] = true
+      if media.URI != nil {
+         errs = append(errs, fmt.Errorf(
+            "EXT-X-MEDIA %q in group %q (line %d): CLOSED-CAPTIONS must not have a URI",
+            media.Name, media.GroupID, media.SourceLine,
+         ))
+      }
+      if media.InstreamID == "" {
+         errs = append(errs, fmt.Errorf(
+            "EXT-X-MEDIA %q in group %q (line %d): CLOSED-CAPTIONS requires INSTREAM-ID",
+            media.Name, media.GroupID, media.SourceLine,
+         ))
+      }
+   }
+   for _, stream := range mp.StreamInfs {
+      if stream.HasClosedCaptions() && !captionGroups[stream.ClosedCaptions] {
+         errs = append(errs, fmt.Errorf(
+            "EXT-X-STREAM-INF (line %d): no CLOSED-CAPTIONS group %q",
+            stream.SourceLine, stream.ClosedCaptions,
+         ))
+      }
+   }
+   return errors.Join(errs...)
+}